@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// An airdrop escrows Total of a token from its funder and commits only to the
+// Merkle sum root over MerkleLeaf(airdropID, address, amount) of its
+// recipients, weighted by amount. A recipient claims its leaf once, signing
+// the claim with its address key, until Deadline, unix seconds. Claims are
+// recorded under AirdropClaimPrefix by leaf hash and only read the airdrop,
+// so they do not conflict with each other; a claim must prove the tree sums to
+// Total, so the claims can not pay out more than was escrowed. After the
+// deadline reclaimAirdrop returns the unclaimed rest to the funder. The
+// deadline is checked against ledger time, which neither the funder nor a
+// recipient can date past.
+
+const (
+	AirdropOpen   = "open"
+	AirdropClosed = "closed"
+)
+
+type Airdrop struct {
+	AirdropID string `json:"airdropID"`
+	TokenID   string `json:"tokenID"`
+	Funder    string `json:"funder"`
+	Root      string `json:"root"`
+	Total     string `json:"total"`
+	Claimed   string `json:"claimed,omitempty"`
+	Deadline  int64  `json:"deadline"`
+	Status    string `json:"status"`
+	TxID      string `json:"txID"`
+}
+
+type AirdropClaim struct {
+	AirdropID string           `json:"airdropID"`
+	Address   string           `json:"address"`
+	Amount    string           `json:"amount"`
+	Proof     []*MerkleSumStep `json:"proof"`
+}
+
+type AirdropClaimRecord struct {
+	AirdropID string `json:"airdropID"`
+	Leaf      string `json:"leaf"`
+	Address   string `json:"address"`
+	Amount    string `json:"amount"`
+	TxID      string `json:"txID"`
+}
+
+func (t *OceanChaincode) getAirdrop(stub shim.ChaincodeStubInterface, airdropID string) (*Airdrop, error) {
+	airdropBytes, err := stub.GetState(AirdropPrefix + airdropID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(airdropBytes) == 0 {
+		return nil, errors.New("airdrop not exist")
+	}
+
+	airdrop := &Airdrop{}
+	err = json.Unmarshal(airdropBytes, airdrop)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return airdrop, nil
+}
+
+func (t *OceanChaincode) putAirdrop(stub shim.ChaincodeStubInterface, airdrop *Airdrop) ([]byte, error) {
+	airdropJson, err := json.Marshal(airdrop)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return airdropJson, stub.PutState(AirdropPrefix+airdrop.AirdropID, airdropJson)
+}
+
+// getAirdropClaimed adds up the claims of an airdrop.
+func (t *OceanChaincode) getAirdropClaimed(stub shim.ChaincodeStubInterface, airdropID string) (*big.Int, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(AirdropClaimPrefix, []string{airdropID})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	claimed := big.NewInt(0)
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		record := &AirdropClaimRecord{}
+		err = json.Unmarshal(responseRange.Value, record)
+		if err != nil {
+			return nil, errors.New("json unmarshal fail")
+		}
+
+		amount, _ := new(big.Int).SetString(record.Amount, 10)
+		claimed.Add(claimed, amount)
+	}
+
+	return claimed, nil
+}
+
+// args: funder pubKey, payload hex of Airdrop{airdropID, tokenID, root, total, deadline}, sign
+func (t *OceanChaincode) fundAirdrop(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	airdrop := Airdrop{}
+	address, err := verifyPayload(stub, "fundAirdrop", args[0], args[1], args[2], &airdrop)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if airdrop.AirdropID == "" {
+		return shim.Error("airdropID is null")
+	}
+
+	if _, err = t.getAirdrop(stub, airdrop.AirdropID); err == nil {
+		return shim.Error("airdrop already existed")
+	}
+
+	if !IsGtZeroInteger(airdrop.Total) {
+		return shim.Error("total need to be greater than 0 integer")
+	}
+
+	if root, err := hex.DecodeString(airdrop.Root); err != nil || len(root) != sha256.Size {
+		return shim.Error("root is invalid")
+	}
+
+	now, err := getLedgerTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if airdrop.Deadline <= now {
+		return shim.Error("deadline need to be in the future")
+	}
+
+	token, err := t.getToken(stub, airdrop.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.debitWallet(stub, token, address, airdrop.TokenID, airdrop.Total, "airdrop:"+airdrop.AirdropID, args[1], nil)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	airdrop.Funder = address
+	airdrop.Claimed = ""
+	airdrop.Status = AirdropOpen
+	airdrop.TxID = stub.GetTxID()
+
+	airdropJson, err := t.putAirdrop(stub, &airdrop)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "FundAirdrop",
+		Ref:     airdrop.AirdropID,
+		TokenID: airdrop.TokenID,
+		From:    address,
+		Number:  airdrop.Total,
+		Data:    airdropJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: recipient pubKey, payload hex of AirdropClaim{airdropID, address, amount, proof}, sign
+func (t *OceanChaincode) claimAirdrop(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	claim := AirdropClaim{}
+	address, err := verifyPayload(stub, "claimAirdrop", args[0], args[1], args[2], &claim)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != claim.Address {
+		return shim.Error("address and public key not match")
+	}
+
+	airdrop, err := t.getAirdrop(stub, claim.AirdropID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if airdrop.Status != AirdropOpen {
+		return shim.Error("airdrop is " + airdrop.Status)
+	}
+
+	now, err := getLedgerTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now > airdrop.Deadline {
+		return shim.Error("airdrop deadline passed")
+	}
+
+	if !IsGtZeroInteger(claim.Amount) {
+		return shim.Error("amount need to be greater than 0 integer")
+	}
+
+	leaf := MerkleLeaf(claim.AirdropID, address, claim.Amount)
+	leafHex := hex.EncodeToString(leaf)
+
+	compositeKey, err := stub.CreateCompositeKey(AirdropClaimPrefix, []string{claim.AirdropID, leafHex})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recordBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(recordBytes) != 0 {
+		return shim.Error("airdrop leaf " + leafHex + " already claimed")
+	}
+
+	amount, _ := new(big.Int).SetString(claim.Amount, 10)
+	sum, verify := VerifyMerkleSumPath(leaf, amount, claim.Proof, airdrop.Root)
+	if !verify {
+		return shim.Error("airdrop proof invalid")
+	}
+
+	if sum.String() != airdrop.Total {
+		return shim.Error("airdrop root sums to " + sum.String() + " not to the escrowed " + airdrop.Total)
+	}
+
+	err = t.checkNotRetired(stub, address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	token, err := t.getToken(stub, airdrop.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putWalletEntry(stub, token.Collection, address, airdrop.TokenID, "+", claim.Amount, "airdrop:"+airdrop.AirdropID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recordJson, err := json.Marshal(&AirdropClaimRecord{
+		AirdropID: claim.AirdropID,
+		Leaf:      leafHex,
+		Address:   address,
+		Amount:    claim.Amount,
+		TxID:      stub.GetTxID(),
+	})
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, recordJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "ClaimAirdrop",
+		Ref:     airdrop.AirdropID,
+		TokenID: airdrop.TokenID,
+		To:      address,
+		Number:  claim.Amount,
+		Data:    recordJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: airdropID
+// returns the unclaimed rest to the funder once the deadline passed
+func (t *OceanChaincode) reclaimAirdrop(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("incorrect number of args")
+	}
+
+	airdrop, err := t.getAirdrop(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if airdrop.Status != AirdropOpen {
+		return shim.Error("airdrop is " + airdrop.Status)
+	}
+
+	now, err := getLedgerTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now <= airdrop.Deadline {
+		return shim.Error("airdrop open until " + strconv.FormatInt(airdrop.Deadline, 10))
+	}
+
+	claimed, err := t.getAirdropClaimed(stub, airdrop.AirdropID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	total, _ := new(big.Int).SetString(airdrop.Total, 10)
+	rest := total.Sub(total, claimed)
+
+	if rest.Sign() > 0 {
+		token, err := t.getToken(stub, airdrop.TokenID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = t.putWalletEntry(stub, token.Collection, airdrop.Funder, airdrop.TokenID, "+", rest.String(), "airdrop:"+airdrop.AirdropID+":reclaim")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	airdrop.Claimed = claimed.String()
+	airdrop.Status = AirdropClosed
+
+	airdropJson, err := t.putAirdrop(stub, airdrop)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "ReclaimAirdrop",
+		Ref:     airdrop.AirdropID,
+		TokenID: airdrop.TokenID,
+		To:      airdrop.Funder,
+		Number:  rest.String(),
+		Data:    airdropJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: airdropID[, leaf hex]
+// returns the airdrop, or the claim of the leaf
+func (t *OceanChaincode) queryAirdrop(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 && len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	if len(args) == 1 {
+		airdropBytes, err := stub.GetState(AirdropPrefix + args[0])
+		if err != nil {
+			res.Msg = err.Error()
+			return t.response(res)
+		}
+
+		if len(airdropBytes) == 0 {
+			res.Msg = "airdrop not exist"
+			return t.response(res)
+		}
+
+		res.Status = true
+		res.Data = airdropBytes
+		return t.response(res)
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(AirdropClaimPrefix, []string{args[0], args[1]})
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	recordBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	if len(recordBytes) == 0 {
+		res.Msg = "airdrop claim not exist"
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = recordBytes
+	return t.response(res)
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A balance attestation publishes the Merkle root over the non-zero
+// balances of a token at the attestation time, one MerkleLeaf(tokenID,
+// address, balance) per holder in address order. Holders are the addresses
+// ever credited the token, indexed under simple HolderPrefix keys so that
+// audits can read them a page at a time from any address on. Like an audit,
+// an attestation takes a snapshot of the token when it starts and then reads
+// up to pageSize holders per call of attestBalances, storing each leaf and
+// the frontier of the tree so far; the last page sets the root. Addresses
+// credited before the index existed can be named when it starts, that call
+// only indexes them. proveBalance builds the path from the stored leaves and
+// VerifyBalanceInclusion checks it offline.
+
+const (
+	AttestationRunning   = "running"
+	AttestationCompleted = "completed"
+)
+
+type Attestation struct {
+	AttestationID string   `json:"attestationID"`
+	TokenID       string   `json:"tokenID"`
+	Holders       []string `json:"holders,omitempty"`
+	PageSize      int      `json:"pageSize,omitempty"`
+}
+
+type BalanceAttestation struct {
+	AttestationID string   `json:"attestationID"`
+	TokenID       string   `json:"tokenID"`
+	Status        string   `json:"status"`
+	Root          string   `json:"root,omitempty"`
+	Leaves        int      `json:"leaves"`
+	Sequence      int64    `json:"sequence"`
+	Timestamp     int64    `json:"timestamp"`
+	TxID          string   `json:"txID"`
+	Cursor        string   `json:"cursor,omitempty"`
+	Frontier      []string `json:"frontier,omitempty"`
+}
+
+type BalanceInclusionProof struct {
+	AttestationID string        `json:"attestationID"`
+	TokenID       string        `json:"tokenID"`
+	Address       string        `json:"address"`
+	Balance       string        `json:"balance"`
+	Leaf          string        `json:"leaf"`
+	Path          []*MerkleStep `json:"path"`
+	Root          string        `json:"root"`
+}
+
+// VerifyBalanceInclusion checks that proof shows the balance of its address in
+// the attestation with the hex root.
+func VerifyBalanceInclusion(root string, proof *BalanceInclusionProof) bool {
+	leaf := MerkleLeaf(proof.TokenID, proof.Address, proof.Balance)
+	if hex.EncodeToString(leaf) != proof.Leaf {
+		return false
+	}
+
+	return VerifyMerklePath(leaf, proof.Path, root)
+}
+
+// holderKey is the key of address in the holder index of tokenID.
+func holderKey(tokenID, address string) string {
+	return HolderPrefix + tokenID + "\x00" + address
+}
+
+// indexHolder records address as a holder of tokenID.
+func (t *OceanChaincode) indexHolder(stub shim.ChaincodeStubInterface, collection, tokenID, address string) error {
+	if collection != "" {
+		return stub.PutPrivateData(collection, holderKey(tokenID, address), []byte{0})
+	}
+
+	return stub.PutState(holderKey(tokenID, address), []byte{0})
+}
+
+// getHolders returns an iterator over the holder index of tokenID after
+// address, from the first holder when after is empty, and the key prefix to
+// cut the addresses from.
+func getHolders(stub shim.ChaincodeStubInterface, collection, tokenID, after string) (shim.StateQueryIteratorInterface, string, error) {
+	prefix := holderKey(tokenID, "")
+	startKey := prefix
+	if after != "" {
+		startKey = holderKey(tokenID, after) + "\x00"
+	}
+	endKey := HolderPrefix + tokenID + "\x01"
+
+	var iterator shim.StateQueryIteratorInterface
+	var err error
+	if collection != "" {
+		iterator, err = stub.GetPrivateDataByRange(collection, startKey, endKey)
+	} else {
+		iterator, err = stub.GetStateByRange(startKey, endKey)
+	}
+
+	return iterator, prefix, err
+}
+
+// balanceLeafKey is the key of the balance of address in the attestation,
+// kept in the collection of a private token.
+func balanceLeafKey(tokenID, attestationID, address string) string {
+	return AttestationLeafPrefix + tokenID + "\x00" + attestationID + "\x00" + address
+}
+
+// getBalanceLeaves returns the addresses and balances stored by the
+// attestation, in address order.
+func getBalanceLeaves(stub shim.ChaincodeStubInterface, collection, tokenID, attestationID string) ([]string, []string, error) {
+	prefix := balanceLeafKey(tokenID, attestationID, "")
+	endKey := AttestationLeafPrefix + tokenID + "\x00" + attestationID + "\x01"
+
+	var iterator shim.StateQueryIteratorInterface
+	var err error
+	if collection != "" {
+		iterator, err = stub.GetPrivateDataByRange(collection, prefix, endKey)
+	} else {
+		iterator, err = stub.GetStateByRange(prefix, endKey)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iterator.Close()
+
+	var addresses, balances []string
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		addresses = append(addresses, strings.TrimPrefix(responseRange.Key, prefix))
+		balances = append(balances, string(responseRange.Value))
+	}
+
+	return addresses, balances, nil
+}
+
+func balanceLeafHashes(tokenID string, addresses, balances []string) [][]byte {
+	leaves := make([][]byte, len(addresses))
+	for i := range addresses {
+		leaves[i] = MerkleLeaf(tokenID, addresses[i], balances[i])
+	}
+
+	return leaves
+}
+
+func (t *OceanChaincode) getAttestation(stub shim.ChaincodeStubInterface, tokenID, attestationID string) (*BalanceAttestation, error) {
+	compositeKey, err := stub.CreateCompositeKey(AttestationPrefix, []string{tokenID, attestationID})
+	if err != nil {
+		return nil, err
+	}
+
+	attestationBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(attestationBytes) == 0 {
+		return nil, errors.New("attestation not exist")
+	}
+
+	attestation := &BalanceAttestation{}
+	err = json.Unmarshal(attestationBytes, attestation)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return attestation, nil
+}
+
+// startAttestation takes the attestation snapshot.
+func (t *OceanChaincode) startAttestation(stub shim.ChaincodeStubInterface, tokenID, attestationID string) (*BalanceAttestation, error) {
+	sequence, err := nextSnapshotSequence(stub, tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BalanceAttestation{
+		AttestationID: attestationID,
+		TokenID:       tokenID,
+		Status:        AttestationRunning,
+		Sequence:      sequence,
+		Timestamp:     timestamp,
+		TxID:          stub.GetTxID(),
+	}, nil
+}
+
+// attestPage adds the non-zero balances of up to pageSize holders after the
+// cursor to the attestation, and sets the root after the last holder.
+func (t *OceanChaincode) attestPage(stub shim.ChaincodeStubInterface, token *Token, attestation *BalanceAttestation, pageSize int) error {
+	iterator, prefix, err := getHolders(stub, token.Collection, attestation.TokenID, attestation.Cursor)
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	frontier := make([][]byte, len(attestation.Frontier))
+	for i, node := range attestation.Frontier {
+		if node != "" {
+			frontier[i], _ = hex.DecodeString(node)
+		}
+	}
+
+	for done := 0; done < pageSize && iterator.HasNext(); done++ {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+
+		address := strings.TrimPrefix(responseRange.Key, prefix)
+		attestation.Cursor = address
+
+		balance, err := t.getBalanceAt(stub, address, attestation.TokenID, attestation.Sequence)
+		if err != nil {
+			return err
+		}
+
+		if balance.Sign() == 0 {
+			continue
+		}
+
+		leafKey := balanceLeafKey(attestation.TokenID, attestation.AttestationID, address)
+		if token.Collection != "" {
+			err = stub.PutPrivateData(token.Collection, leafKey, []byte(balance.String()))
+		} else {
+			err = stub.PutState(leafKey, []byte(balance.String()))
+		}
+		if err != nil {
+			return err
+		}
+
+		frontier = merkleAppend(frontier, MerkleLeaf(attestation.TokenID, address, balance.String()))
+		attestation.Leaves++
+	}
+
+	attestation.Frontier = make([]string, len(frontier))
+	for i, node := range frontier {
+		if node != nil {
+			attestation.Frontier[i] = hex.EncodeToString(node)
+		}
+	}
+
+	if iterator.HasNext() {
+		return nil
+	}
+
+	if attestation.Leaves == 0 {
+		return errors.New("token has no holder")
+	}
+
+	attestation.Root = hex.EncodeToString(merkleFrontierRoot(frontier))
+	attestation.Status = AttestationCompleted
+	attestation.Cursor = ""
+	attestation.Frontier = nil
+	return nil
+}
+
+// args: issuer pubKey, payload hex of Attestation{attestationID, tokenID, holders, pageSize}, sign
+// starts or continues the attestation, holders can only be named when it starts
+func (t *OceanChaincode) attestBalances(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	payload := Attestation{}
+	address, err := verifyPayload(stub, "attestBalances", args[0], args[1], args[2], &payload)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if payload.AttestationID == "" || payload.TokenID == "" {
+		return shim.Error("attestationID or tokenID is null string")
+	}
+
+	pageSize := auditPageSize
+	if payload.PageSize != 0 {
+		if payload.PageSize < 1 || payload.PageSize > auditMaxPageSize {
+			return shim.Error("pageSize need to be between 1 and " + strconv.Itoa(auditMaxPageSize))
+		}
+		pageSize = payload.PageSize
+	}
+
+	token, err := t.getToken(stub, payload.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != token.Address {
+		return shim.Error("only token issuer can attest balances")
+	}
+
+	if token.Confidential {
+		return shim.Error("balances of confidential token can not be attested")
+	}
+
+	attestation, err := t.getAttestation(stub, payload.TokenID, payload.AttestationID)
+	if err != nil {
+		attestation, err = t.startAttestation(stub, payload.TokenID, payload.AttestationID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else if attestation.Status != AttestationRunning {
+		return shim.Error("attestation already " + attestation.Status)
+	} else if len(payload.Holders) > 0 {
+		return shim.Error("holders can only be named when the attestation starts")
+	}
+
+	// the index does not show holders written in this transaction, so the
+	// pages read them from the next call on
+	if len(payload.Holders) > 0 {
+		for _, holder := range payload.Holders {
+			if !IsValidAddress(holder) {
+				return shim.Error("holder is invalid: " + holder)
+			}
+
+			err = t.indexHolder(stub, token.Collection, payload.TokenID, holder)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	} else {
+		err = t.attestPage(stub, token, attestation, pageSize)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	attestationJson, err := json.Marshal(attestation)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(AttestationPrefix, []string{payload.TokenID, payload.AttestationID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = stub.PutState(compositeKey, attestationJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "AttestBalances",
+		Ref:     payload.AttestationID,
+		TokenID: payload.TokenID,
+		From:    address,
+		Data:    attestationJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: tokenID, attestationID, address
+// returns the BalanceInclusionProof of address, to check with VerifyBalanceInclusion
+func (t *OceanChaincode) proveBalance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 3 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	tokenID, address := args[0], args[2]
+
+	attestation, err := t.getAttestation(stub, tokenID, args[1])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	if attestation.Status != AttestationCompleted {
+		res.Msg = "attestation is " + attestation.Status
+		return t.response(res)
+	}
+
+	token, err := t.getToken(stub, tokenID)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	addresses, balances, err := getBalanceLeaves(stub, token.Collection, tokenID, attestation.AttestationID)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	leaves := balanceLeafHashes(tokenID, addresses, balances)
+	if hex.EncodeToString(MerkleRoot(leaves)) != attestation.Root {
+		res.Msg = "attestation leaves do not match its root"
+		return t.response(res)
+	}
+
+	index := sort.SearchStrings(addresses, address)
+	if index == len(addresses) || addresses[index] != address {
+		res.Msg = "address not in attestation"
+		return t.response(res)
+	}
+
+	proofData, err := json.Marshal(&BalanceInclusionProof{
+		AttestationID: attestation.AttestationID,
+		TokenID:       tokenID,
+		Address:       address,
+		Balance:       balances[index],
+		Leaf:          hex.EncodeToString(leaves[index]),
+		Path:          MerklePath(leaves, index),
+		Root:          attestation.Root,
+	})
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = proofData
+	return t.response(res)
+}
+
+// args: tokenID, attestationID
+func (t *OceanChaincode) queryAttestation(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	attestation, err := t.getAttestation(stub, args[0], args[1])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	attestationData, err := json.Marshal(attestation)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = attestationData
+	return t.response(res)
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// auditToken reconciles a token over several invocations of up to pageSize
+// holders each, so no single transaction has to read every wallet. The first
+// page takes a snapshot of the token and records the expected supply and the
+// tokens held in escrow by orders, pools, holds, payment channels, airdrops
+// and the bridge; every page then sums the holder balances at that snapshot
+// and reports negative or malformed wallets. The last page checks that
+// wallets plus escrow add up to the supply, and every page emits the record
+// so far. Only the creator that started an audit may run its further pages
+// and sign it. Holders credited before the holder index existed can be named
+// when the audit starts; that call only indexes them and takes the snapshot,
+// the pages then read them from the index. The auditor then signs the digest
+// of the finished report with signAudit, using the signer of its auditor role
+// binding.
+
+const (
+	AuditRunning   = "running"
+	AuditCompleted = "completed"
+	AuditSigned    = "signed"
+
+	auditPageSize    = 100
+	auditMaxPageSize = 1000
+)
+
+type AuditDiscrepancy struct {
+	Address string `json:"address,omitempty"`
+	Kind    string `json:"kind"`
+	Detail  string `json:"detail"`
+}
+
+type AuditRecord struct {
+	AuditID       string              `json:"auditID"`
+	TokenID       string              `json:"tokenID"`
+	Auditor       string              `json:"auditor"`
+	Status        string              `json:"status"`
+	Sequence      int64               `json:"sequence"`
+	Timestamp     int64               `json:"timestamp"`
+	Supply        string              `json:"supply"`
+	Escrow        map[string]string   `json:"escrow"`
+	Cursor        string              `json:"cursor,omitempty"`
+	Pages         int                 `json:"pages"`
+	Holders       int                 `json:"holders"`
+	WalletSum     string              `json:"walletSum"`
+	Discrepancies []*AuditDiscrepancy `json:"discrepancies"`
+	Balanced      bool                `json:"balanced"`
+	Digest        string              `json:"digest,omitempty"`
+	Signer        string              `json:"signer,omitempty"`
+	Signature     string              `json:"signature,omitempty"`
+	TxIDs         []string            `json:"txIDs"`
+}
+
+// auditDigest hashes the finished report, without the fields signAudit sets.
+func auditDigest(record *AuditRecord) (string, error) {
+	report := *record
+	report.Status = AuditCompleted
+	report.Digest = ""
+	report.Signer = ""
+	report.Signature = ""
+
+	reportJson, err := json.Marshal(&report)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256(reportJson)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+func (t *OceanChaincode) getAuditRecord(stub shim.ChaincodeStubInterface, tokenID, auditID string) (string, *AuditRecord, error) {
+	compositeKey, err := stub.CreateCompositeKey(AuditPrefix, []string{tokenID, auditID})
+	if err != nil {
+		return "", nil, err
+	}
+
+	recordBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(recordBytes) == 0 {
+		return compositeKey, nil, nil
+	}
+
+	record := &AuditRecord{}
+	err = json.Unmarshal(recordBytes, record)
+	if err != nil {
+		return "", nil, errors.New("json unmarshal fail")
+	}
+
+	return compositeKey, record, nil
+}
+
+// scanPrefix iterates the simple keys starting with prefix.
+func scanPrefix(stub shim.ChaincodeStubInterface, prefix string, visit func(value []byte) error) error {
+	iterator, err := stub.GetStateByRange(prefix, prefix+string(utf8.MaxRune))
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+
+		err = visit(responseRange.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addEscrow adds number to the escrow of kind.
+func addEscrow(escrow map[string]*big.Int, kind, number string) error {
+	amount, success := new(big.Int).SetString(number, 10)
+	if !success {
+		return errors.New(kind + " number not match: " + number)
+	}
+
+	if escrow[kind] == nil {
+		escrow[kind] = big.NewInt(0)
+	}
+	escrow[kind].Add(escrow[kind], amount)
+	return nil
+}
+
+// getEscrow returns the tokens of tokenID held outside wallets by kind.
+func (t *OceanChaincode) getEscrow(stub shim.ChaincodeStubInterface, tokenID string) (map[string]*big.Int, error) {
+	escrow := make(map[string]*big.Int)
+
+	iterator, err := stub.GetStateByPartialCompositeKey(OrderBookPrefix, []string{tokenID})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		order := &Order{}
+		err = json.Unmarshal(responseRange.Value, order)
+		if err != nil {
+			return nil, errors.New("json unmarshal fail")
+		}
+
+		err = addEscrow(escrow, "order", order.Remaining)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = scanPrefix(stub, PoolPrefix, func(value []byte) error {
+		pool := &Pool{}
+		if json.Unmarshal(value, pool) != nil {
+			return errors.New("json unmarshal fail")
+		}
+
+		if pool.TokenA == tokenID {
+			return addEscrow(escrow, "pool", pool.ReserveA)
+		}
+		if pool.TokenB == tokenID {
+			return addEscrow(escrow, "pool", pool.ReserveB)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanPrefix(stub, HoldPrefix, func(value []byte) error {
+		hold := &Hold{}
+		if json.Unmarshal(value, hold) != nil {
+			return errors.New("json unmarshal fail")
+		}
+
+		if hold.TokenID == tokenID && hold.Status == HoldHeld {
+			return addEscrow(escrow, "hold", hold.Number)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanPrefix(stub, PaymentChannelPrefix, func(value []byte) error {
+		channel := &PaymentChannel{}
+		if json.Unmarshal(value, channel) != nil {
+			return errors.New("json unmarshal fail")
+		}
+
+		if channel.TokenID == tokenID && channel.Status != PaymentChannelClosed {
+			return addEscrow(escrow, "channel", channel.Deposit)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanPrefix(stub, AirdropPrefix, func(value []byte) error {
+		airdrop := &Airdrop{}
+		if json.Unmarshal(value, airdrop) != nil {
+			return errors.New("json unmarshal fail")
+		}
+
+		if airdrop.TokenID != tokenID || airdrop.Status != AirdropOpen {
+			return nil
+		}
+
+		claimed, err := t.getAirdropClaimed(stub, airdrop.AirdropID)
+		if err != nil {
+			return err
+		}
+
+		total, _ := new(big.Int).SetString(airdrop.Total, 10)
+		return addEscrow(escrow, "airdrop", total.Sub(total, claimed).String())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// locked tokens are on other channels as wrapped tokens
+	bridgeIterator, err := stub.GetStateByPartialCompositeKey(BridgeSupplyPrefix, []string{tokenID, BridgeOut})
+	if err != nil {
+		return nil, err
+	}
+	defer bridgeIterator.Close()
+
+	for bridgeIterator.HasNext() {
+		responseRange, err := bridgeIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		supply := &BridgeSupply{}
+		err = json.Unmarshal(responseRange.Value, supply)
+		if err != nil {
+			return nil, errors.New("json unmarshal fail")
+		}
+
+		err = addEscrow(escrow, "bridge", supply.Number)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return escrow, nil
+}
+
+// auditWallet sums the wallet of address for tokenID at the snapshot with
+// sequence like getBalanceAt, but reports malformed entries instead of failing
+// on them.
+func (t *OceanChaincode) auditWallet(stub shim.ChaincodeStubInterface, address, tokenID string, sequence int64) (*big.Int, []*AuditDiscrepancy, error) {
+	iterator, err := t.getWalletIterator(stub, address, tokenID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iterator.Close()
+
+	balance := big.NewInt(0)
+	var discrepancies []*AuditDiscrepancy
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		entry, err := getWalletEntry(responseRange.Value)
+		if err != nil || len(compositeKeyParts) != 4 {
+			discrepancies = append(discrepancies, &AuditDiscrepancy{Address: address, Kind: "malformed", Detail: "wallet entry " + strconv.Quote(responseRange.Key)})
+			continue
+		}
+
+		if entry.Sequence >= sequence {
+			continue
+		}
+
+		operation, number := compositeKeyParts[1], compositeKeyParts[2]
+		numBigInt, success := new(big.Int).SetString(number, 10)
+		if !success || numBigInt.Sign() < 0 || (operation != "+" && operation != "-") {
+			discrepancies = append(discrepancies, &AuditDiscrepancy{Address: address, Kind: "malformed", Detail: "wallet entry " + operation + " " + number + " ref " + compositeKeyParts[3]})
+			continue
+		}
+
+		if operation == "+" {
+			balance.Add(balance, numBigInt)
+		} else {
+			balance.Sub(balance, numBigInt)
+		}
+	}
+
+	if balance.Sign() < 0 {
+		discrepancies = append(discrepancies, &AuditDiscrepancy{Address: address, Kind: "negative", Detail: "balance " + balance.String()})
+	}
+
+	return balance, discrepancies, nil
+}
+
+// startAudit takes the audit snapshot and fixes the expected supply and the
+// escrow.
+func (t *OceanChaincode) startAudit(stub shim.ChaincodeStubInterface, token *Token, tokenID, auditID, auditor string) (*AuditRecord, error) {
+	sequence, err := nextSnapshotSequence(stub, tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &AuditRecord{
+		AuditID:   auditID,
+		TokenID:   tokenID,
+		Auditor:   auditor,
+		Status:    AuditRunning,
+		Sequence:  sequence,
+		Timestamp: timestamp,
+		Supply:    token.TotalNumber,
+		Escrow:    make(map[string]string),
+		WalletSum: "0",
+	}
+
+	// a wrapped token is backed by what its home channel bridged in
+	if token.Origin != nil {
+		supply, err := t.getBridgeSupply(stub, token.Origin.TokenID, BridgeIn, token.Origin.Channel)
+		if err != nil {
+			return nil, err
+		}
+		record.Supply = supply.String()
+	}
+
+	escrow, err := t.getEscrow(stub, tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	for kind, number := range escrow {
+		record.Escrow[kind] = number.String()
+	}
+
+	return record, nil
+}
+
+// args: tokenID, auditID[, pageSize[, holder...]]
+// starts or continues the audit, returns the audit record. Holders can only be
+// named when the audit starts.
+func (t *OceanChaincode) auditToken(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error("incorrect number of args")
+	}
+
+	tokenID, auditID := args[0], args[1]
+	if auditID == "" {
+		return shim.Error("auditID is null")
+	}
+
+	pageSize := auditPageSize
+	if len(args) >= 3 {
+		size, err := strconv.Atoi(args[2])
+		if err != nil || size < 1 || size > auditMaxPageSize {
+			return shim.Error("pageSize need to be between 1 and " + strconv.Itoa(auditMaxPageSize))
+		}
+		pageSize = size
+	}
+
+	token, err := t.getToken(stub, tokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if token.Confidential {
+		return shim.Error("balances of confidential token can not be audited")
+	}
+
+	creator, err := getCreatorIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	compositeKey, record, err := t.getAuditRecord(stub, tokenID, auditID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var holders []string
+	if len(args) > 3 {
+		holders = args[3:]
+	}
+
+	if record == nil {
+		record, err = t.startAudit(stub, token, tokenID, auditID, creator.Address)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else if record.Auditor != creator.Address {
+		return shim.Error("audit is run by " + record.Auditor)
+	} else if record.Status != AuditRunning {
+		return shim.Error("audit already " + record.Status)
+	} else if len(holders) > 0 {
+		return shim.Error("holders can only be named when the audit starts")
+	}
+
+	// the index does not show holders written in this transaction, so the
+	// pages read them from the next call on
+	if len(holders) > 0 {
+		for _, holder := range holders {
+			if !IsValidAddress(holder) {
+				return shim.Error("holder is invalid: " + holder)
+			}
+
+			err = t.indexHolder(stub, token.Collection, tokenID, holder)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+
+		return t.putAuditRecord(stub, compositeKey, record)
+	}
+
+	// each page reads the holders after the cursor only
+	iterator, prefix, err := getHolders(stub, token.Collection, tokenID, record.Cursor)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer iterator.Close()
+
+	walletSum, _ := new(big.Int).SetString(record.WalletSum, 10)
+	done := 0
+	for done < pageSize && iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		address := strings.TrimPrefix(responseRange.Key, prefix)
+		balance, discrepancies, err := t.auditWallet(stub, address, tokenID, record.Sequence)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		walletSum.Add(walletSum, balance)
+		record.Discrepancies = append(record.Discrepancies, discrepancies...)
+		record.Cursor = address
+		record.Holders++
+		done++
+	}
+
+	record.WalletSum = walletSum.String()
+	record.Pages++
+	record.TxIDs = append(record.TxIDs, stub.GetTxID())
+
+	if !iterator.HasNext() {
+		expected, _ := new(big.Int).SetString(record.Supply, 10)
+		held := new(big.Int).Set(walletSum)
+
+		kinds := make([]string, 0, len(record.Escrow))
+		for kind := range record.Escrow {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			number, _ := new(big.Int).SetString(record.Escrow[kind], 10)
+			held.Add(held, number)
+		}
+
+		if held.Cmp(expected) != 0 {
+			record.Discrepancies = append(record.Discrepancies, &AuditDiscrepancy{
+				Kind:   "supply",
+				Detail: "wallets and escrow hold " + held.String() + ", supply is " + expected.String(),
+			})
+		}
+
+		record.Balanced = len(record.Discrepancies) == 0
+		record.Status = AuditCompleted
+		record.Cursor = ""
+		record.Digest, err = auditDigest(record)
+		if err != nil {
+			return shim.Error("Json marshal fail: " + err.Error())
+		}
+	}
+
+	return t.putAuditRecord(stub, compositeKey, record)
+}
+
+// putAuditRecord stores the running record and emits it.
+func (t *OceanChaincode) putAuditRecord(stub shim.ChaincodeStubInterface, compositeKey string, record *AuditRecord) pb.Response {
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, recordJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "AuditToken",
+		Ref:     record.AuditID,
+		TokenID: record.TokenID,
+		Number:  record.WalletSum,
+		Data:    recordJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(recordJson)
+}
+
+// args: tokenID, auditID, auditor pubKey, sign of the audit digest
+// the key must be the signer of an auditor role binding of the creator
+func (t *OceanChaincode) signAudit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("incorrect number of args")
+	}
+
+	compositeKey, record, err := t.getAuditRecord(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if record == nil {
+		return shim.Error("audit not exist")
+	}
+
+	if record.Status != AuditCompleted {
+		return shim.Error("audit is " + record.Status)
+	}
+
+	verify, err := Verify(args[2], record.Digest, args[3])
+	if err != nil || !verify {
+		return shim.Error("verify fail")
+	}
+
+	creator, err := getCreatorIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if record.Auditor != creator.Address {
+		return shim.Error("audit is run by " + record.Auditor)
+	}
+
+	signer := GetAddress(args[2])
+	registered, err := t.isRoleSigner(stub, creator, RoleAuditor, signer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !registered {
+		return shim.Error("signer " + signer + " is not registered for an auditor role binding of the creator")
+	}
+
+	record.Signer = signer
+	record.Signature = args[3]
+	record.Status = AuditSigned
+
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, recordJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "SignAudit",
+		Ref:     record.AuditID,
+		TokenID: record.TokenID,
+		From:    record.Signer,
+		Data:    recordJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: tokenID, auditID
+func (t *OceanChaincode) queryAudit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	_, record, err := t.getAuditRecord(stub, args[0], args[1])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	if record == nil {
+		res.Msg = "audit not exist"
+		return t.response(res)
+	}
+
+	recordData, err := json.Marshal(record)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = recordData
+	return t.response(res)
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The bridge moves tokens between channels running this chaincode. lockToken
+// takes tokens out of circulation on their home channel and returns a lock
+// receipt. Bridge validators sign the receipt hex off-chain and mintWrapped
+// on the target channel credits a wrapped token once Threshold of them did.
+// burnWrapped destroys wrapped tokens and returns a burn receipt, which
+// unlockToken on the home channel redeems the same way. Permissioned tokens
+// and tokens with a compliance module or claim rules are not bridged, the
+// wrapped token would let them move without those checks.
+
+const (
+	BridgeConfigKey = "BridgeConfig"
+
+	BridgeLock = "lock"
+	BridgeBurn = "burn"
+
+	BridgeOut = "out"
+	BridgeIn  = "in"
+)
+
+// BridgeConfig is set once by its first signer, who becomes Admin and is the
+// only one allowed to change it afterwards. Validators are public keys hex.
+type BridgeConfig struct {
+	Admin      string   `json:"admin"`
+	Validators []string `json:"validators"`
+	Threshold  int      `json:"threshold"`
+}
+
+// TokenOrigin marks a wrapped token and points to the token it wraps.
+type TokenOrigin struct {
+	Channel string `json:"channel"`
+	TokenID string `json:"tokenID"`
+}
+
+// BridgeReceipt is produced on SourceChannel and redeemed on TargetChannel.
+// TokenID is always the token on its home channel.
+type BridgeReceipt struct {
+	Kind          string `json:"kind"`
+	ID            string `json:"id"`
+	TokenID       string `json:"tokenID"`
+	TokenName     string `json:"tokenName"`
+	From          string `json:"from"`
+	Recipient     string `json:"recipient"`
+	Number        string `json:"number"`
+	SourceChannel string `json:"sourceChannel"`
+	TargetChannel string `json:"targetChannel"`
+}
+
+type BridgeSignature struct {
+	PubKey string `json:"pubKey"`
+	Sign   string `json:"sign"`
+}
+
+// BridgeSupply is the outstanding bridged amount of a home token towards
+// (out) or from (in) another channel.
+type BridgeSupply struct {
+	TokenID   string `json:"tokenID"`
+	Direction string `json:"direction"`
+	Channel   string `json:"channel"`
+	Number    string `json:"number"`
+}
+
+func wrappedTokenID(channel, tokenID string) string {
+	return channel + "/" + tokenID
+}
+
+// addTotalNumber adds number, which may be negative, to the supply of a
+// wrapped token.
+func (t *OceanChaincode) addTotalNumber(stub shim.ChaincodeStubInterface, tokenID string, token *Token, number *big.Int) error {
+	total, success := new(big.Int).SetString(token.TotalNumber, 10)
+	if !success {
+		return errors.New("totalNumber not match: " + token.TotalNumber)
+	}
+
+	token.TotalNumber = total.Add(total, number).String()
+
+	tokenJson, err := json.Marshal(token)
+	if err != nil {
+		return errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return t.putToken(stub, tokenID, tokenJson)
+}
+
+func (t *OceanChaincode) getBridgeConfig(stub shim.ChaincodeStubInterface) (*BridgeConfig, error) {
+	configBytes, err := stub.GetState(BridgeConfigKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(configBytes) == 0 {
+		return nil, errors.New("bridge not configured")
+	}
+
+	config := &BridgeConfig{}
+	err = json.Unmarshal(configBytes, config)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return config, nil
+}
+
+// args: pubKey, payload hex of BridgeConfig{validators, threshold}, sign
+func (t *OceanChaincode) configureBridge(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	config := BridgeConfig{}
+	address, err := verifyPayload(stub, "configureBridge", args[0], args[1], args[2], &config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	current, err := t.getBridgeConfig(stub)
+	if err == nil && current.Admin != address {
+		return shim.Error("only bridge admin can configure bridge")
+	}
+
+	seen := make(map[string]bool)
+	for _, validator := range config.Validators {
+		if GetAddress(validator) == "" || seen[validator] {
+			return shim.Error("validators must be unique public keys")
+		}
+		seen[validator] = true
+	}
+
+	if config.Threshold < 1 || config.Threshold > len(config.Validators) {
+		return shim.Error("threshold need to be between 1 and number of validators")
+	}
+
+	config.Admin = address
+
+	configJson, err := json.Marshal(&config)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(BridgeConfigKey, configJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action: "ConfigureBridge",
+		From:   address,
+		Data:   configJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// verifyReceipt checks that at least Threshold distinct bridge validators
+// signed receiptHex and decodes it.
+func (t *OceanChaincode) verifyReceipt(stub shim.ChaincodeStubInterface, receiptHex, signaturesJson string) (*BridgeReceipt, error) {
+	config, err := t.getBridgeConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var signatures []BridgeSignature
+	err = json.Unmarshal([]byte(signaturesJson), &signatures)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	signed := make(map[string]bool)
+	for _, signature := range signatures {
+		if signed[signature.PubKey] || !inSlice(signature.PubKey, config.Validators) {
+			continue
+		}
+
+		verify, err := Verify(signature.PubKey, receiptHex, signature.Sign)
+		if err == nil && verify {
+			signed[signature.PubKey] = true
+		}
+	}
+
+	if len(signed) < config.Threshold {
+		return nil, errors.New("not enough validator signatures")
+	}
+
+	receiptJson, err := hex.DecodeString(receiptHex)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &BridgeReceipt{}
+	err = json.Unmarshal(receiptJson, receipt)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	if receipt.TargetChannel != stub.GetChannelID() {
+		return nil, errors.New("receipt is for channel " + receipt.TargetChannel)
+	}
+
+	if !IsGtZeroInteger(receipt.Number) {
+		return nil, errors.New("number need to be greater than 0 integer")
+	}
+
+	return receipt, nil
+}
+
+// markReceipt records that a receipt was redeemed and fails on replays.
+func (t *OceanChaincode) markReceipt(stub shim.ChaincodeStubInterface, receipt *BridgeReceipt) error {
+	compositeKey, err := stub.CreateCompositeKey(BridgeReceiptPrefix, []string{receipt.SourceChannel, receipt.Kind, receipt.ID})
+	if err != nil {
+		return err
+	}
+
+	receiptBytes, err := stub.GetState(compositeKey)
+	if len(receiptBytes) != 0 {
+		return errors.New("receipt already redeemed")
+	}
+
+	return stub.PutState(compositeKey, []byte(stub.GetTxID()))
+}
+
+func (t *OceanChaincode) getBridgeSupply(stub shim.ChaincodeStubInterface, tokenID, direction, channel string) (*big.Int, error) {
+	compositeKey, err := stub.CreateCompositeKey(BridgeSupplyPrefix, []string{tokenID, direction, channel})
+	if err != nil {
+		return nil, err
+	}
+
+	supplyBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	supply := BridgeSupply{Number: "0"}
+	if len(supplyBytes) != 0 {
+		err = json.Unmarshal(supplyBytes, &supply)
+		if err != nil {
+			return nil, errors.New("json unmarshal fail")
+		}
+	}
+
+	number, success := new(big.Int).SetString(supply.Number, 10)
+	if !success {
+		return nil, errors.New("number not match: " + supply.Number)
+	}
+
+	return number, nil
+}
+
+// addBridgeSupply adds delta, which may be negative, to the outstanding
+// bridged supply and refuses to take it below zero.
+func (t *OceanChaincode) addBridgeSupply(stub shim.ChaincodeStubInterface, tokenID, direction, channel string, delta *big.Int) error {
+	number, err := t.getBridgeSupply(stub, tokenID, direction, channel)
+	if err != nil {
+		return err
+	}
+
+	number.Add(number, delta)
+	if number.Sign() < 0 {
+		return errors.New("bridged supply of " + tokenID + " " + direction + " " + channel + " less than " + new(big.Int).Neg(delta).String())
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(BridgeSupplyPrefix, []string{tokenID, direction, channel})
+	if err != nil {
+		return err
+	}
+
+	supplyJson, err := json.Marshal(&BridgeSupply{
+		TokenID:   tokenID,
+		Direction: direction,
+		Channel:   channel,
+		Number:    number.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(compositeKey, supplyJson)
+}
+
+// debitBridge checks and debits a signed lock or burn request and returns
+// the receipt for it. args may end with a co-signer public key and signature.
+func (t *OceanChaincode) debitBridge(stub shim.ChaincodeStubInterface, kind string, args []string) (*BridgeReceipt, []byte, error) {
+	if len(args) != 3 && len(args) != 5 {
+		return nil, nil, errors.New("incorrect number of args")
+	}
+
+	action := "lockToken"
+	if kind == BridgeBurn {
+		action = "burnWrapped"
+	}
+
+	receipt := &BridgeReceipt{}
+	address, err := verifyPayload(stub, action, args[0], args[1], args[2], receipt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if receipt.ID == "" || receipt.TokenID == "" {
+		return nil, nil, errors.New("id or tokenID is null string")
+	}
+
+	if !IsGtZeroInteger(receipt.Number) {
+		return nil, nil, errors.New("number need to be greater than 0 integer")
+	}
+
+	if !IsValidAddress(receipt.Recipient) {
+		return nil, nil, errors.New("recipient is invalid")
+	}
+
+	token, err := t.getToken(stub, receipt.TokenID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if token.Collection != "" {
+		return nil, nil, errors.New("private token can not be bridged")
+	}
+
+	err = t.checkNotRetired(stub, address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(BridgeReceiptPrefix, []string{stub.GetChannelID(), kind, receipt.ID})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	receiptBytes, err := stub.GetState(compositeKey)
+	if len(receiptBytes) != 0 {
+		return nil, nil, errors.New(kind + " already existed")
+	}
+
+	receipt.Kind = kind
+	receipt.From = address
+	receipt.SourceChannel = stub.GetChannelID()
+	homeTokenID := receipt.TokenID
+
+	if kind == BridgeLock {
+		if token.Origin != nil {
+			return nil, nil, errors.New("wrapped token can not be locked, use burnWrapped")
+		}
+
+		if receipt.TargetChannel == "" || receipt.TargetChannel == receipt.SourceChannel {
+			return nil, nil, errors.New("targetChannel is invalid")
+		}
+
+		// the wrapped token would not carry the restrictions
+		rules, err := t.getClaimRules(stub, receipt.TokenID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if token.Permissioned || token.Compliance != "" || (rules != nil && len(rules.Rules) != 0) {
+			return nil, nil, errors.New("restricted token can not be bridged")
+		}
+	} else {
+		if token.Origin == nil {
+			return nil, nil, errors.New("token is not wrapped, use lockToken")
+		}
+
+		homeTokenID = token.Origin.TokenID
+		receipt.TargetChannel = token.Origin.Channel
+	}
+
+	balance, err := t.getTokenBalance(stub, address, receipt.TokenID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	number, _ := new(big.Int).SetString(receipt.Number, 10)
+	if balance.Cmp(number) < 0 {
+		return nil, nil, errors.New("balance of address " + balance.String() + " less than " + "number " + receipt.Number)
+	}
+
+	err = t.checkSpendingLimit(stub, address, receipt.TokenID, receipt.Number, args[1], args[3:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = t.putWalletEntry(stub, "", address, receipt.TokenID, "-", receipt.Number, kind+":"+receipt.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if kind == BridgeLock {
+		err = t.addBridgeSupply(stub, homeTokenID, BridgeOut, receipt.TargetChannel, number)
+	} else {
+		err = t.addBridgeSupply(stub, homeTokenID, BridgeIn, receipt.TargetChannel, new(big.Int).Neg(number))
+		if err == nil {
+			err = t.addTotalNumber(stub, receipt.TokenID, token, new(big.Int).Neg(number))
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	receipt.TokenID = homeTokenID
+	receipt.TokenName = token.TokenName
+
+	receiptJson, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, receiptJson)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return receipt, receiptJson, nil
+}
+
+// args: pubKey, payload hex of BridgeReceipt{id, tokenID, number, recipient, targetChannel}, sign[, coSigner pubKey, coSigner sign]
+// returns the lock receipt for the validators to sign
+func (t *OceanChaincode) lockToken(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	receipt, receiptJson, err := t.debitBridge(stub, BridgeLock, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "LockToken",
+		Ref:     receipt.ID,
+		TokenID: receipt.TokenID,
+		From:    receipt.From,
+		To:      receipt.Recipient,
+		Number:  receipt.Number,
+		Data:    receiptJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(receiptJson)
+}
+
+// args: pubKey, payload hex of BridgeReceipt{id, tokenID of wrapped token, number, recipient}, sign[, coSigner pubKey, coSigner sign]
+// returns the burn receipt for the validators to sign
+func (t *OceanChaincode) burnWrapped(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	receipt, receiptJson, err := t.debitBridge(stub, BridgeBurn, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "BurnWrapped",
+		Ref:     receipt.ID,
+		TokenID: wrappedTokenID(receipt.TargetChannel, receipt.TokenID),
+		From:    receipt.From,
+		To:      receipt.Recipient,
+		Number:  receipt.Number,
+		Data:    receiptJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(receiptJson)
+}
+
+// args: lock receipt hex, JSON array of BridgeSignature
+func (t *OceanChaincode) mintWrapped(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("incorrect number of args")
+	}
+
+	receipt, err := t.verifyReceipt(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if receipt.Kind != BridgeLock {
+		return shim.Error("receipt is not a lock receipt")
+	}
+
+	err = t.markReceipt(stub, receipt)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tokenID := wrappedTokenID(receipt.SourceChannel, receipt.TokenID)
+	origin := TokenOrigin{Channel: receipt.SourceChannel, TokenID: receipt.TokenID}
+
+	token := &Token{TokenName: receipt.TokenName, TotalNumber: "0", Origin: &origin}
+	tokenBytes, err := stub.GetState(TokenPrefix + tokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(tokenBytes) != 0 {
+		token = &Token{}
+		err = json.Unmarshal(tokenBytes, token)
+		if err != nil {
+			return shim.Error("json unmarshal fail")
+		}
+
+		if token.Origin == nil || *token.Origin != origin {
+			return shim.Error("token " + tokenID + " does not wrap " + receipt.TokenID + " of channel " + receipt.SourceChannel)
+		}
+	}
+
+	receiptJson, err := json.Marshal(receipt)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	number, _ := new(big.Int).SetString(receipt.Number, 10)
+	err = t.addBridgeSupply(stub, receipt.TokenID, BridgeIn, receipt.SourceChannel, number)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.addTotalNumber(stub, tokenID, token, number)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putTokenWalletEntry(stub, token, "", receipt.Recipient, tokenID, "+", receipt.Number, "mint:"+receipt.ID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "MintWrapped",
+		Ref:     receipt.ID,
+		TokenID: tokenID,
+		To:      receipt.Recipient,
+		Number:  receipt.Number,
+		Data:    receiptJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: burn receipt hex, JSON array of BridgeSignature
+func (t *OceanChaincode) unlockToken(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("incorrect number of args")
+	}
+
+	receipt, err := t.verifyReceipt(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if receipt.Kind != BridgeBurn {
+		return shim.Error("receipt is not a burn receipt")
+	}
+
+	err = t.markReceipt(stub, receipt)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	receiptJson, err := json.Marshal(receipt)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	number, _ := new(big.Int).SetString(receipt.Number, 10)
+	err = t.addBridgeSupply(stub, receipt.TokenID, BridgeOut, receipt.SourceChannel, new(big.Int).Neg(number))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putWalletEntry(stub, "", receipt.Recipient, receipt.TokenID, "+", receipt.Number, "unlock:"+receipt.SourceChannel+":"+receipt.ID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "UnlockToken",
+		Ref:     receipt.ID,
+		TokenID: receipt.TokenID,
+		To:      receipt.Recipient,
+		Number:  receipt.Number,
+		Data:    receiptJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: tokenID on its home channel, channel
+func (t *OceanChaincode) queryBridgeSupply(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	var supplies []*BridgeSupply
+	for _, direction := range []string{BridgeOut, BridgeIn} {
+		number, err := t.getBridgeSupply(stub, args[0], direction, args[1])
+		if err != nil {
+			res.Msg = err.Error()
+			return t.response(res)
+		}
+
+		supplies = append(supplies, &BridgeSupply{
+			TokenID:   args[0],
+			Direction: direction,
+			Channel:   args[1],
+			Number:    number.String(),
+		})
+	}
+
+	supplyData, err := json.Marshal(supplies)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = supplyData
+	return t.response(res)
+}
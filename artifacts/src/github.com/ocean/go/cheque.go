@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A cheque is signed offline by the payer with Sign over the hex of its JSON,
+// with action cashCheque. It carries no txID, the payer's Serial makes it
+// single use instead: cashing or voiding a serial records it under
+// ChequePrefix. Voiding takes a separate ChequeVoid signed with action
+// voidCheque, so whoever sees a cheque can not void it.
+
+const (
+	ChequeCashed = "cashed"
+	ChequeVoided = "voided"
+)
+
+type Cheque struct {
+	Payer   string `json:"payer"`
+	Payee   string `json:"payee"`
+	TokenID string `json:"tokenID"`
+	Number  string `json:"number"`
+	Serial  string `json:"serial"`
+	Expiry  int64  `json:"expiry"`
+	Memo    string `json:"memo,omitempty"`
+}
+
+type ChequeVoid struct {
+	Payer  string `json:"payer"`
+	Serial string `json:"serial"`
+}
+
+type ChequeRecord struct {
+	Payer  string  `json:"payer"`
+	Serial string  `json:"serial"`
+	Status string  `json:"status"`
+	TxID   string  `json:"txID"`
+	Cheque *Cheque `json:"cheque,omitempty"`
+}
+
+func (t *OceanChaincode) getChequeRecord(stub shim.ChaincodeStubInterface, payer, serial string) (string, *ChequeRecord, error) {
+	compositeKey, err := stub.CreateCompositeKey(ChequePrefix, []string{payer, serial})
+	if err != nil {
+		return "", nil, err
+	}
+
+	recordBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(recordBytes) == 0 {
+		return compositeKey, nil, nil
+	}
+
+	record := &ChequeRecord{}
+	err = json.Unmarshal(recordBytes, record)
+	if err != nil {
+		return "", nil, errors.New("json unmarshal fail")
+	}
+
+	return compositeKey, record, nil
+}
+
+// args: payer pubKey, cheque hex, payer sign[, coSigner pubKey, coSigner sign]
+func (t *OceanChaincode) cashCheque(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 5 {
+		return shim.Error("incorrect number of args")
+	}
+
+	cheque := Cheque{}
+	address, err := verifyPayload(stub, "cashCheque", args[0], args[1], args[2], &cheque)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != cheque.Payer {
+		return shim.Error("payer and public key not match")
+	}
+
+	if !IsValidAddress(cheque.Payee) || cheque.Payee == cheque.Payer {
+		return shim.Error("payee is invalid")
+	}
+
+	if cheque.Serial == "" {
+		return shim.Error("serial is null")
+	}
+
+	if !IsGtZeroInteger(cheque.Number) {
+		return shim.Error("number need to be greater than 0 integer")
+	}
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now/int64(time.Second) > cheque.Expiry {
+		return shim.Error("cheque expired")
+	}
+
+	token, err := t.getToken(stub, cheque.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if token.Collection != "" {
+		return shim.Error("private token can not be paid by cheque")
+	}
+
+	compositeKey, record, err := t.getChequeRecord(stub, cheque.Payer, cheque.Serial)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if record != nil {
+		return shim.Error("cheque serial already " + record.Status)
+	}
+
+	err = t.checkNotRetired(stub, cheque.Payee)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ref := "cheque:" + cheque.Payer + ":" + cheque.Serial
+
+	err = t.debitWallet(stub, token, cheque.Payer, cheque.TokenID, cheque.Number, ref, args[1], args[3:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putWalletEntry(stub, token.Collection, cheque.Payee, cheque.TokenID, "+", cheque.Number, ref)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recordJson, err := json.Marshal(&ChequeRecord{
+		Payer:  cheque.Payer,
+		Serial: cheque.Serial,
+		Status: ChequeCashed,
+		TxID:   stub.GetTxID(),
+		Cheque: &cheque,
+	})
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, recordJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "CashCheque",
+		Ref:     cheque.Serial,
+		TokenID: cheque.TokenID,
+		From:    cheque.Payer,
+		To:      cheque.Payee,
+		Number:  cheque.Number,
+		Memo:    cheque.Memo,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: payer pubKey, payload hex of ChequeVoid{payer, serial}, payer sign
+func (t *OceanChaincode) voidCheque(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	cheque := ChequeVoid{}
+	address, err := verifyPayload(stub, "voidCheque", args[0], args[1], args[2], &cheque)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != cheque.Payer {
+		return shim.Error("payer and public key not match")
+	}
+
+	if cheque.Serial == "" {
+		return shim.Error("serial is null")
+	}
+
+	compositeKey, record, err := t.getChequeRecord(stub, cheque.Payer, cheque.Serial)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if record != nil {
+		return shim.Error("cheque serial already " + record.Status)
+	}
+
+	recordJson, err := json.Marshal(&ChequeRecord{
+		Payer:  cheque.Payer,
+		Serial: cheque.Serial,
+		Status: ChequeVoided,
+		TxID:   stub.GetTxID(),
+	})
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, recordJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action: "VoidCheque",
+		Ref:    cheque.Serial,
+		From:   cheque.Payer,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: payer, serial
+func (t *OceanChaincode) queryCheque(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	_, record, err := t.getChequeRecord(stub, args[0], args[1])
+	if err != nil || record == nil {
+		res.Msg = "cheque serial not used"
+		return t.response(res)
+	}
+
+	recordData, err := json.Marshal(record)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = recordData
+	return t.response(res)
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Attestors sign claims about an address, such as kyc.level=2 until some
+// expiry, and may revoke them. Each claim has an ID its attestor never issues
+// again, so a revoked claim stays revoked. An attestor is trusted for one
+// token, by that token's issuer, or globally, by an admin. A token's
+// ClaimRules then require its senders or recipients to hold a matching,
+// unexpired, unrevoked claim from a trusted attestor; checkAllowed enforces
+// them on every wallet entry, telling expiry by ledger time. Rule changes
+// carry the token's compliance sequence like the allowlist does.
+
+const (
+	// GlobalScope is the attestor scope of no particular token.
+	GlobalScope = ""
+
+	PartySender    = "sender"
+	PartyRecipient = "recipient"
+	PartyBoth      = "both"
+)
+
+// claimOperators in the order they are looked for in a requirement.
+var claimOperators = []string{">=", "<=", "!=", "==", ">", "<", "="}
+
+type AttestorRegistration struct {
+	TokenID  string `json:"tokenID"`
+	Attestor string `json:"attestor"`
+	Remove   bool   `json:"remove"`
+}
+
+type Claim struct {
+	ClaimID  string `json:"claimID"`
+	Subject  string `json:"subject"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Expiry   int64  `json:"expiry"`
+	Attestor string `json:"attestor"`
+}
+
+type ClaimRevocation struct {
+	ClaimID string `json:"claimID"`
+	Subject string `json:"subject"`
+	Type    string `json:"type"`
+}
+
+type ClaimRecord struct {
+	Claim   *Claim `json:"claim"`
+	TxID    string `json:"txID"`
+	Revoked bool   `json:"revoked"`
+}
+
+// ClaimRule requires Party to hold a claim satisfying Require, such as
+// "kyc.level>=2" or just "accredited", from one of Attestors, or from any
+// attestor trusted for the token when Attestors is empty.
+type ClaimRule struct {
+	Party     string   `json:"party"`
+	Require   string   `json:"require"`
+	Attestors []string `json:"attestors"`
+}
+
+type TokenClaimRules struct {
+	TokenID  string       `json:"tokenID"`
+	Rules    []*ClaimRule `json:"rules"`
+	Sequence int64        `json:"sequence"`
+}
+
+// parseRequirement splits a requirement into claim type, operator and value.
+// A bare claim type only requires the claim to exist.
+func parseRequirement(require string) (string, string, string, error) {
+	for _, op := range claimOperators {
+		i := strings.Index(require, op)
+		if i < 0 {
+			continue
+		}
+
+		claimType := strings.TrimSpace(require[:i])
+		value := strings.TrimSpace(require[i+len(op):])
+		if claimType == "" || value == "" {
+			return "", "", "", errors.New("requirement is invalid: " + require)
+		}
+
+		if op == "=" {
+			op = "=="
+		}
+
+		return claimType, op, value, nil
+	}
+
+	claimType := strings.TrimSpace(require)
+	if claimType == "" {
+		return "", "", "", errors.New("requirement is invalid: " + require)
+	}
+
+	return claimType, "", "", nil
+}
+
+// matchClaim compares a claim value with a required one, as numbers when both
+// are numeric and as strings otherwise.
+func matchClaim(value, op, required string) bool {
+	if op == "" {
+		return true
+	}
+
+	var c int
+	left, leftOk := new(big.Rat).SetString(value)
+	right, rightOk := new(big.Rat).SetString(required)
+	if leftOk && rightOk {
+		c = left.Cmp(right)
+	} else {
+		c = strings.Compare(value, required)
+	}
+
+	switch op {
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case "<":
+		return c < 0
+	case "!=":
+		return c != 0
+	}
+
+	return c == 0
+}
+
+func (t *OceanChaincode) isAttestor(stub shim.ChaincodeStubInterface, tokenID, attestor string) (bool, error) {
+	for _, scope := range []string{tokenID, GlobalScope} {
+		compositeKey, err := stub.CreateCompositeKey(AttestorPrefix, []string{scope, attestor})
+		if err != nil {
+			return false, err
+		}
+
+		attestorBytes, err := stub.GetState(compositeKey)
+		if err != nil {
+			return false, err
+		}
+
+		if len(attestorBytes) != 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (t *OceanChaincode) getClaimRules(stub shim.ChaincodeStubInterface, tokenID string) (*TokenClaimRules, error) {
+	rulesBytes, err := stub.GetState(ClaimRulePrefix + tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rulesBytes) == 0 {
+		return nil, nil
+	}
+
+	rules := &TokenClaimRules{}
+	err = json.Unmarshal(rulesBytes, rules)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return rules, nil
+}
+
+// hasClaim reports whether subject holds a claim satisfying rule for tokenID.
+func (t *OceanChaincode) hasClaim(stub shim.ChaincodeStubInterface, tokenID, subject string, rule *ClaimRule, now int64) (bool, error) {
+	claimType, op, required, err := parseRequirement(rule.Require)
+	if err != nil {
+		return false, err
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(ClaimPrefix, []string{subject, claimType})
+	if err != nil {
+		return false, err
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return false, err
+		}
+
+		record := &ClaimRecord{}
+		err = json.Unmarshal(responseRange.Value, record)
+		if err != nil {
+			return false, errors.New("json unmarshal fail")
+		}
+
+		claim := record.Claim
+		if record.Revoked || (claim.Expiry != 0 && now >= claim.Expiry) {
+			continue
+		}
+
+		if len(rule.Attestors) != 0 && !inSlice(claim.Attestor, rule.Attestors) {
+			continue
+		}
+
+		trusted, err := t.isAttestor(stub, tokenID, claim.Attestor)
+		if err != nil {
+			return false, err
+		}
+
+		if trusted && matchClaim(claim.Value, op, required) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// checkClaimRules fails if address, acting as party, lacks a claim one of
+// the rules of tokenID requires.
+func (t *OceanChaincode) checkClaimRules(stub shim.ChaincodeStubInterface, tokenID, address, party string) error {
+	rules, err := t.getClaimRules(stub, tokenID)
+	if err != nil || rules == nil {
+		return err
+	}
+
+	now, err := getLedgerTime(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules.Rules {
+		if rule.Party != party && rule.Party != PartyBoth {
+			continue
+		}
+
+		held, err := t.hasClaim(stub, tokenID, address, rule, now)
+		if err != nil {
+			return err
+		}
+
+		if !held {
+			return errors.New(party + " " + address + " lacks claim " + rule.Require + " for " + tokenID)
+		}
+	}
+
+	return nil
+}
+
+// args: pubKey, payload hex of AttestorRegistration{tokenID, attestor, remove}, sign
+// the token issuer manages the attestors of a token, an admin global ones
+func (t *OceanChaincode) registerAttestor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	registration := AttestorRegistration{}
+	address, err := verifyPayload(stub, "registerAttestor", args[0], args[1], args[2], &registration)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !IsValidAddress(registration.Attestor) {
+		return shim.Error("attestor is invalid")
+	}
+
+	if registration.TokenID == GlobalScope {
+		creator, err := getCreatorIdentity(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		admin, err := t.hasRole(stub, creator, RoleAdmin)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if !admin {
+			return shim.Error("only admin can register global attestor")
+		}
+	} else {
+		token, err := t.getToken(stub, registration.TokenID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if address != token.Address {
+			return shim.Error("only token issuer can register attestor")
+		}
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(AttestorPrefix, []string{registration.TokenID, registration.Attestor})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if registration.Remove {
+		err = stub.DelState(compositeKey)
+	} else {
+		err = stub.PutState(compositeKey, []byte(stub.GetTxID()))
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	registrationJson, err := json.Marshal(&registration)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "RegisterAttestor",
+		TokenID: registration.TokenID,
+		From:    address,
+		Data:    registrationJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: attestor pubKey, claim hex of Claim{claimID, subject, type, value, expiry, attestor}, sign
+func (t *OceanChaincode) issueClaim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	claim := Claim{}
+	address, err := verifyPayload(stub, "issueClaim", args[0], args[1], args[2], &claim)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != claim.Attestor {
+		return shim.Error("attestor and public key not match")
+	}
+
+	if claim.ClaimID == "" {
+		return shim.Error("claimID is null")
+	}
+
+	if !IsValidAddress(claim.Subject) {
+		return shim.Error("subject is invalid")
+	}
+
+	claimType, _, _, err := parseRequirement(claim.Type)
+	if err != nil || claimType != claim.Type {
+		return shim.Error("claim type is invalid")
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(ClaimPrefix, []string{claim.Subject, claim.Type, claim.Attestor, claim.ClaimID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recordBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(recordBytes) != 0 {
+		return shim.Error("claim " + claim.ClaimID + " already issued")
+	}
+
+	recordJson, err := json.Marshal(&ClaimRecord{Claim: &claim, TxID: stub.GetTxID()})
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, recordJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action: "IssueClaim",
+		Ref:    claim.Type,
+		From:   claim.Attestor,
+		To:     claim.Subject,
+		Data:   recordJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: attestor pubKey, payload hex of ClaimRevocation{claimID, subject, type}, sign
+func (t *OceanChaincode) revokeClaim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	request := ClaimRevocation{}
+	address, err := verifyPayload(stub, "revokeClaim", args[0], args[1], args[2], &request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(ClaimPrefix, []string{request.Subject, request.Type, address, request.ClaimID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recordBytes, err := stub.GetState(compositeKey)
+	if len(recordBytes) == 0 || err != nil {
+		return shim.Error("claim not exist")
+	}
+
+	record := ClaimRecord{}
+	err = json.Unmarshal(recordBytes, &record)
+	if err != nil {
+		return shim.Error("json unmarshal fail")
+	}
+
+	if record.Revoked {
+		return shim.Error("claim " + request.ClaimID + " already revoked")
+	}
+
+	record.Revoked = true
+	record.TxID = stub.GetTxID()
+
+	recordJson, err := json.Marshal(&record)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, recordJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action: "RevokeClaim",
+		Ref:    request.Type,
+		From:   address,
+		To:     request.Subject,
+		Data:   recordJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: issuer or compliance pubKey, payload hex of TokenClaimRules{tokenID, rules, sequence}, sign
+// replaces the claim rules of the token, no rules removes them
+func (t *OceanChaincode) setClaimRules(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	rules := TokenClaimRules{}
+	address, err := verifyPayload(stub, "setClaimRules", args[0], args[1], args[2], &rules)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	token, err := t.getToken(stub, rules.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if isLPToken(rules.TokenID) {
+		return shim.Error("LP token has no issuer")
+	}
+
+	if address != token.Address && (token.Compliance == "" || address != token.Compliance) {
+		return shim.Error("only token issuer or compliance can set claim rules")
+	}
+
+	for _, rule := range rules.Rules {
+		if rule.Party != PartySender && rule.Party != PartyRecipient && rule.Party != PartyBoth {
+			return shim.Error("party need to be " + PartySender + ", " + PartyRecipient + " or " + PartyBoth)
+		}
+
+		_, _, _, err = parseRequirement(rule.Require)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = spendComplianceSequence(stub, rules.TokenID, rules.Sequence)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	rulesJson, err := json.Marshal(&rules)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	if len(rules.Rules) == 0 {
+		err = stub.DelState(ClaimRulePrefix + rules.TokenID)
+	} else {
+		err = stub.PutState(ClaimRulePrefix+rules.TokenID, rulesJson)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "SetClaimRules",
+		TokenID: rules.TokenID,
+		From:    address,
+		Data:    rulesJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: subject address[, claim type]
+func (t *OceanChaincode) queryClaims(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 && len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(ClaimPrefix, args)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+	defer iterator.Close()
+
+	records := []*ClaimRecord{}
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			res.Msg = err.Error()
+			return t.response(res)
+		}
+
+		record := &ClaimRecord{}
+		err = json.Unmarshal(responseRange.Value, record)
+		if err != nil {
+			res.Msg = "json unmarshal fail"
+			return t.response(res)
+		}
+
+		records = append(records, record)
+	}
+
+	recordsData, err := json.Marshal(records)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = recordsData
+	return t.response(res)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The transaction timestamp is chosen by the client, so a delay or deadline
+// checked against it alone is skipped by backdating or forward-dating the
+// transaction. Timekeepers publish the time with tick, more often than
+// MaxClockDrift, and getLedgerTime only accepts a timestamp between the
+// published time and MaxClockDrift after it. Until a timekeeper ticks,
+// timestamps are taken as they are.
+
+const MaxClockDrift = 10 * 60
+
+type LedgerClock struct {
+	Time int64  `json:"time"`
+	TxID string `json:"txID"`
+}
+
+func getLedgerClock(stub shim.ChaincodeStubInterface) (*LedgerClock, error) {
+	clockBytes, err := stub.GetState(LedgerClockKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clock := &LedgerClock{}
+	if len(clockBytes) == 0 {
+		return clock, nil
+	}
+
+	err = json.Unmarshal(clockBytes, clock)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return clock, nil
+}
+
+// getLedgerTime returns the transaction timestamp in unix seconds, failing
+// unless it is within MaxClockDrift after the time published last.
+func getLedgerTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return 0, err
+	}
+	now = now / int64(time.Second)
+
+	clock, err := getLedgerClock(stub)
+	if err != nil || clock.Time == 0 {
+		return now, err
+	}
+
+	if now < clock.Time || now > clock.Time+MaxClockDrift {
+		return 0, errors.New("transaction time " + strconv.FormatInt(now, 10) + " too far from ledger clock " + strconv.FormatInt(clock.Time, 10))
+	}
+
+	return now, nil
+}
+
+// args: none, the transaction timestamp is the published time
+func (t *OceanChaincode) tick(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("incorrect number of args")
+	}
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now = now / int64(time.Second)
+
+	clock, err := getLedgerClock(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now <= clock.Time {
+		return shim.Error("time need to be greater than " + strconv.FormatInt(clock.Time, 10))
+	}
+
+	clockJson, err := json.Marshal(&LedgerClock{Time: now, TxID: stub.GetTxID()})
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(LedgerClockKey, clockJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action: "Tick",
+		Data:   clockJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: none
+func (t *OceanChaincode) queryClock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 0 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	clock, err := getLedgerClock(stub)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	clockData, err := json.Marshal(clock)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = clockData
+	return t.response(res)
+}
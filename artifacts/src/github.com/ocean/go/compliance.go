@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A permissioned token may only move between addresses on its allowlist,
+// kept under AllowlistPrefix by the issuer or the compliance officer the
+// issuer delegates to. putWalletEntry checks every entry, so each debit and
+// credit path is covered; the issuer itself is always allowed. Changes to
+// a token's compliance settings carry the token's next compliance sequence,
+// so a signed change can not be applied after a later one.
+
+type Permission struct {
+	TokenID      string `json:"tokenID"`
+	Permissioned bool   `json:"permissioned"`
+	Compliance   string `json:"compliance"`
+	Sequence     int64  `json:"sequence"`
+}
+
+type AllowlistUpdate struct {
+	TokenID  string   `json:"tokenID"`
+	Add      []string `json:"add"`
+	Remove   []string `json:"remove"`
+	Sequence int64    `json:"sequence"`
+}
+
+type AllowlistEntry struct {
+	TokenID string `json:"tokenID"`
+	Address string `json:"address"`
+	Listed  bool   `json:"listed"`
+}
+
+func (t *OceanChaincode) isAllowlisted(stub shim.ChaincodeStubInterface, tokenID, address string) (bool, error) {
+	compositeKey, err := stub.CreateCompositeKey(AllowlistPrefix, []string{tokenID, address})
+	if err != nil {
+		return false, err
+	}
+
+	listedBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return false, err
+	}
+
+	return len(listedBytes) != 0, nil
+}
+
+// spendComplianceSequence fails unless sequence follows the last compliance
+// change of tokenID, and records it as the last.
+func spendComplianceSequence(stub shim.ChaincodeStubInterface, tokenID string, sequence int64) error {
+	sequenceBytes, err := stub.GetState(ComplianceSeqPrefix + tokenID)
+	if err != nil {
+		return err
+	}
+
+	var last int64
+	if len(sequenceBytes) != 0 {
+		last, err = strconv.ParseInt(string(sequenceBytes), 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+
+	if sequence != last+1 {
+		return errors.New("compliance sequence of " + tokenID + " must be " + strconv.FormatInt(last+1, 10))
+	}
+
+	return stub.PutState(ComplianceSeqPrefix+tokenID, []byte(strconv.FormatInt(sequence, 10)))
+}
+
+// checkAllowed fails if token is permissioned and address, acting as
+// party, is not on its allowlist, or if address lacks a claim the token's
+// rules require of party.
+func (t *OceanChaincode) checkAllowed(stub shim.ChaincodeStubInterface, token *Token, tokenID, address, party string) error {
+	if address == token.Address {
+		return nil
+	}
+
+	if token.Permissioned {
+		listed, err := t.isAllowlisted(stub, tokenID, address)
+		if err != nil {
+			return err
+		}
+
+		if !listed {
+			return errors.New(party + " " + address + " not in allowlist of " + tokenID)
+		}
+	}
+
+	return t.checkClaimRules(stub, tokenID, address, party)
+}
+
+// args: issuer pubKey, payload hex of Permission{tokenID, permissioned, compliance, sequence}, sign
+func (t *OceanChaincode) setPermissioned(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	permission := Permission{}
+	address, err := verifyPayload(stub, "setPermissioned", args[0], args[1], args[2], &permission)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	token, err := t.getToken(stub, permission.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if isLPToken(permission.TokenID) {
+		return shim.Error("LP token has no issuer")
+	}
+
+	if address != token.Address {
+		return shim.Error("only token issuer can set permissioned")
+	}
+
+	if permission.Compliance != "" && !IsValidAddress(permission.Compliance) {
+		return shim.Error("compliance is invalid")
+	}
+
+	err = spendComplianceSequence(stub, permission.TokenID, permission.Sequence)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	token.Permissioned = permission.Permissioned
+	token.Compliance = permission.Compliance
+
+	tokenJson, err := json.Marshal(token)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = t.putToken(stub, permission.TokenID, tokenJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "SetPermissioned",
+		TokenID: permission.TokenID,
+		From:    address,
+		Data:    tokenJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: issuer or compliance pubKey, payload hex of AllowlistUpdate{tokenID, add, remove, sequence}, sign
+func (t *OceanChaincode) updateAllowlist(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	update := AllowlistUpdate{}
+	address, err := verifyPayload(stub, "updateAllowlist", args[0], args[1], args[2], &update)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	token, err := t.getToken(stub, update.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != token.Address && (token.Compliance == "" || address != token.Compliance) {
+		return shim.Error("only token issuer or compliance can update allowlist")
+	}
+
+	err = spendComplianceSequence(stub, update.TokenID, update.Sequence)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, listed := range update.Add {
+		if !IsValidAddress(listed) {
+			return shim.Error("address is invalid: " + listed)
+		}
+
+		compositeKey, err := stub.CreateCompositeKey(AllowlistPrefix, []string{update.TokenID, listed})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = stub.PutState(compositeKey, []byte(stub.GetTxID()))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	for _, unlisted := range update.Remove {
+		compositeKey, err := stub.CreateCompositeKey(AllowlistPrefix, []string{update.TokenID, unlisted})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = stub.DelState(compositeKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	updateJson, err := json.Marshal(&update)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "UpdateAllowlist",
+		TokenID: update.TokenID,
+		From:    address,
+		Data:    updateJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: tokenID, address
+func (t *OceanChaincode) queryAllowlist(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	listed, err := t.isAllowlisted(stub, args[0], args[1])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	entryData, err := json.Marshal(&AllowlistEntry{TokenID: args[0], Address: args[1], Listed: listed})
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = entryData
+	return t.response(res)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"github.com/hyperledger/fabric-amcl/amcl/FP256BN"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A confidential token keeps Pedersen commitments instead of numbers in its
+// wallet entries, under ConfidentialPrefix. The balance of an address is the
+// sum of its "+" commitments minus its "-" ones. A transfer debits and
+// credits the same amount commitment, so supply is conserved, and carries
+// range proofs that the amount and the sender's remaining balance are not
+// negative. The recipient learns the opening from the note sealed to it.
+// Only the total supply, fixed at issue and committed with a zero blinding,
+// is public.
+
+type ConfidentialEntry struct {
+	Operation  string `json:"operation"`
+	Commitment string `json:"commitment"`
+	Note       string `json:"note,omitempty"`
+	TxID       string `json:"txID"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+type ConfidentialTransfer struct {
+	FromAddress    string      `json:"fromAddress"`
+	ToAddress      string      `json:"toAddress"`
+	TokenID        string      `json:"tokenID"`
+	TxID           string      `json:"txID"`
+	Commitment     string      `json:"commitment"`
+	AmountProof    *RangeProof `json:"amountProof,omitempty"`
+	RemainderProof *RangeProof `json:"remainderProof,omitempty"`
+	Note           string      `json:"note"`
+	Memo           string      `json:"memo,omitempty"`
+}
+
+type ConfidentialBalance struct {
+	Address    string               `json:"address"`
+	TokenID    string               `json:"tokenID"`
+	Commitment string               `json:"commitment"`
+	Entries    []*ConfidentialEntry `json:"entries"`
+}
+
+// checkConfidentialSupply fails unless totalNumber can be range proven.
+func checkConfidentialSupply(totalNumber string) error {
+	total, _ := new(big.Int).SetString(totalNumber, 10)
+	if total.BitLen() > RangeBits {
+		return errors.New("totalNumber of confidential token need to be less than 2^64")
+	}
+
+	return nil
+}
+
+func (t *OceanChaincode) putConfidentialEntry(stub shim.ChaincodeStubInterface, token *Token, address, tokenID, operation string, commitment *FP256BN.ECP, note, txID string) error {
+	party := "recipient"
+	if operation == "-" {
+		party = "sender"
+	}
+
+	err := t.checkAllowed(stub, token, tokenID, address, party)
+	if err != nil {
+		return err
+	}
+
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	entryJson, err := json.Marshal(&ConfidentialEntry{
+		Operation:  operation,
+		Commitment: PointToHex(commitment),
+		Note:       note,
+		TxID:       txID,
+		Timestamp:  timestamp,
+	})
+	if err != nil {
+		return errors.New("Json marshal fail: " + err.Error())
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(ConfidentialPrefix, []string{address, tokenID, txID, operation})
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(compositeKey, entryJson)
+}
+
+// getConfidentialBalance sums the commitments of address for tokenID.
+func (t *OceanChaincode) getConfidentialBalance(stub shim.ChaincodeStubInterface, address, tokenID string) (*FP256BN.ECP, []*ConfidentialEntry, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(ConfidentialPrefix, []string{address, tokenID})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iterator.Close()
+
+	balance := FP256BN.NewECP()
+	var entries []*ConfidentialEntry
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		entry := &ConfidentialEntry{}
+		err = json.Unmarshal(responseRange.Value, entry)
+		if err != nil {
+			return nil, nil, errors.New("json unmarshal fail")
+		}
+
+		commitment, err := PointFromHex(entry.Commitment)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if entry.Operation == "-" {
+			balance.Sub(commitment)
+		} else {
+			balance.Add(commitment)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return balance, entries, nil
+}
+
+// issueConfidential credits the issuer the whole supply, committed with a
+// zero blinding. checkConfidentialSupply must have passed.
+func (t *OceanChaincode) issueConfidential(stub shim.ChaincodeStubInterface, token *Token, tokenID string) error {
+	total, _ := new(big.Int).SetString(token.TotalNumber, 10)
+	commitment := Commit(total.Uint64(), FP256BN.NewBIGint(0))
+
+	return t.putConfidentialEntry(stub, token, token.Address, tokenID, "+", commitment, "", "issueToken")
+}
+
+// args: pubKey, payload hex of ConfidentialTransfer, sign
+func (t *OceanChaincode) transferConfidential(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	tx := ConfidentialTransfer{}
+	address, err := verifyPayload(stub, "transferConfidential", args[0], args[1], args[2], &tx)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != tx.FromAddress {
+		return shim.Error("address and public key not match")
+	}
+
+	if tx.TxID == "" {
+		return shim.Error("txID is null")
+	}
+
+	if !IsValidAddress(tx.ToAddress) {
+		return shim.Error("toAddress is invalid")
+	}
+
+	if tx.FromAddress == tx.ToAddress {
+		return shim.Error("fromAddress and toAddress can not be same")
+	}
+
+	err = t.checkNotRetired(stub, tx.FromAddress)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.checkNotRetired(stub, tx.ToAddress)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	token, err := t.getToken(stub, tx.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !token.Confidential {
+		return shim.Error("token is not confidential, use transfer")
+	}
+
+	transferBytes, err := stub.GetState(TransferPrefix + tx.TxID)
+	if len(transferBytes) != 0 {
+		return shim.Error("transfer already existed")
+	}
+
+	amount, err := PointFromHex(tx.Commitment)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = VerifyRange(amount, tx.AmountProof)
+	if err != nil {
+		return shim.Error("amount " + err.Error())
+	}
+
+	balance, _, err := t.getConfidentialBalance(stub, tx.FromAddress, tx.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	remainder := NewPoint(balance)
+	remainder.Sub(amount)
+
+	err = VerifyRange(remainder, tx.RemainderProof)
+	if err != nil {
+		return shim.Error("remainder " + err.Error())
+	}
+
+	if _, err = hex.DecodeString(tx.Note); err != nil {
+		return shim.Error("note is invalid")
+	}
+
+	err = t.putConfidentialEntry(stub, token, tx.FromAddress, tx.TokenID, "-", amount, "", tx.TxID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putConfidentialEntry(stub, token, tx.ToAddress, tx.TokenID, "+", amount, tx.Note, tx.TxID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tx.AmountProof = nil
+	tx.RemainderProof = nil
+	txJson, err := json.Marshal(&tx)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(TransferPrefix+tx.TxID, txJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "TransferConfidential",
+		Ref:     tx.TxID,
+		TokenID: tx.TokenID,
+		From:    tx.FromAddress,
+		To:      tx.ToAddress,
+		Memo:    tx.Memo,
+		Data:    txJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: address, tokenID
+// returns the balance commitment and the entries, with their notes, behind it
+func (t *OceanChaincode) queryConfidentialBalance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	balance, entries, err := t.getConfidentialBalance(stub, args[0], args[1])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	commitment := ""
+	if !balance.Is_infinity() {
+		commitment = PointToHex(balance)
+	}
+
+	balanceData, err := json.Marshal(&ConfidentialBalance{
+		Address:    args[0],
+		TokenID:    args[1],
+		Commitment: commitment,
+		Entries:    entries,
+	})
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = balanceData
+	return t.response(res)
+}
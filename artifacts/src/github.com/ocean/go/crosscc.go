@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Functions other chaincodes on the channel reach through InvokeChaincode:
+//
+//	balanceOf(address, tokenID)
+//	hold(holdID, address, tokenID, number[, pubKey, payload hex of Hold, sign])
+//	settle(holdID, toAddress)
+//	release(holdID)
+//
+// The calling chaincode must be registered as trusted for the token by its
+// issuer. Fabric does not tell a chaincode which chaincode invoked it, so the
+// caller is the chaincode the client proposal was addressed to: when it
+// reaches this chaincode through other chaincodes, those in between are not
+// checked, including the one making the call. Registering a chaincode thus
+// trusts every chaincode it calls to pass on only what it meant to. A hold
+// moves the owner's tokens only if the owner signed the hold or has
+// authorized the calling chaincode with an allowance beforehand.
+
+const (
+	HoldHeld     = "held"
+	HoldSettled  = "settled"
+	HoldReleased = "released"
+)
+
+// TrustedCaller is registered by the token issuer. Chaincode is matched
+// against the chaincode of the client proposal, not the immediate caller.
+// When MSPIDs is not empty, the proposal creator must also belong to one of
+// them.
+type TrustedCaller struct {
+	TokenID   string   `json:"tokenID"`
+	Chaincode string   `json:"chaincode"`
+	MSPIDs    []string `json:"mspIDs"`
+	Enabled   bool     `json:"enabled"`
+}
+
+// CallerAuthorization lets a trusted chaincode hold up to Allowance of the
+// owner's tokens without a signature per hold.
+type CallerAuthorization struct {
+	Address   string `json:"address"`
+	TokenID   string `json:"tokenID"`
+	Chaincode string `json:"chaincode"`
+	Allowance string `json:"allowance"`
+}
+
+type Hold struct {
+	HoldID    string `json:"holdID"`
+	Address   string `json:"address"`
+	TokenID   string `json:"tokenID"`
+	Number    string `json:"number"`
+	Chaincode string `json:"chaincode"`
+	Creator   string `json:"creator"`
+	Status    string `json:"status"`
+	SettledTo string `json:"settledTo,omitempty"`
+}
+
+// args: pubKey, payload hex of TrustedCaller, sign
+func (t *OceanChaincode) registerCaller(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	caller := TrustedCaller{}
+	address, err := verifyPayload(stub, "registerCaller", args[0], args[1], args[2], &caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if caller.TokenID == "" || caller.Chaincode == "" {
+		return shim.Error("tokenID or chaincode is null string")
+	}
+
+	token, err := t.getToken(stub, caller.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != token.Address {
+		return shim.Error("only token issuer can register caller")
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(TrustedCallerPrefix, []string{caller.TokenID, caller.Chaincode})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	callerJson, err := json.Marshal(&caller)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, callerJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "RegisterCaller",
+		Ref:     caller.Chaincode,
+		TokenID: caller.TokenID,
+		From:    address,
+		Data:    callerJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: pubKey, payload hex of CallerAuthorization{tokenID, chaincode, allowance}, sign
+func (t *OceanChaincode) authorizeCaller(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	auth := CallerAuthorization{}
+	address, err := verifyPayload(stub, "authorizeCaller", args[0], args[1], args[2], &auth)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if auth.TokenID == "" || auth.Chaincode == "" {
+		return shim.Error("tokenID or chaincode is null string")
+	}
+
+	if auth.Allowance != "0" && !IsGtZeroInteger(auth.Allowance) {
+		return shim.Error("allowance need to be a non-negative integer")
+	}
+
+	_, err = t.getToken(stub, auth.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	auth.Address = address
+
+	authJson, err := t.putCallerAuthorization(stub, &auth)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "AuthorizeCaller",
+		Ref:     auth.Chaincode,
+		TokenID: auth.TokenID,
+		From:    address,
+		Number:  auth.Allowance,
+		Data:    authJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+func (t *OceanChaincode) putCallerAuthorization(stub shim.ChaincodeStubInterface, auth *CallerAuthorization) ([]byte, error) {
+	compositeKey, err := stub.CreateCompositeKey(CallerAuthPrefix, []string{auth.Address, auth.TokenID, auth.Chaincode})
+	if err != nil {
+		return nil, err
+	}
+
+	authJson, err := json.Marshal(auth)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return authJson, stub.PutState(compositeKey, authJson)
+}
+
+func (t *OceanChaincode) getCallerAuthorization(stub shim.ChaincodeStubInterface, address, tokenID, chaincode string) (*CallerAuthorization, error) {
+	compositeKey, err := stub.CreateCompositeKey(CallerAuthPrefix, []string{address, tokenID, chaincode})
+	if err != nil {
+		return nil, err
+	}
+
+	authBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(authBytes) == 0 {
+		return nil, nil
+	}
+
+	auth := &CallerAuthorization{}
+	err = json.Unmarshal(authBytes, auth)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return auth, nil
+}
+
+// checkCaller returns the calling chaincode if it is trusted for tokenID.
+func (t *OceanChaincode) checkCaller(stub shim.ChaincodeStubInterface, tokenID string) (string, string, error) {
+	chaincode, err := getCallerChaincode(stub)
+	if err != nil {
+		return "", "", err
+	}
+
+	creator, err := getCreator(stub)
+	if err != nil {
+		return "", "", err
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(TrustedCallerPrefix, []string{tokenID, chaincode})
+	if err != nil {
+		return "", "", err
+	}
+
+	callerBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	caller := TrustedCaller{}
+	if len(callerBytes) != 0 {
+		err = json.Unmarshal(callerBytes, &caller)
+		if err != nil {
+			return "", "", errors.New("json unmarshal fail")
+		}
+	}
+
+	if !caller.Enabled {
+		return "", "", errors.New("chaincode " + chaincode + " is not trusted for token " + tokenID)
+	}
+
+	if len(caller.MSPIDs) != 0 && !inSlice(creator.Mspid, caller.MSPIDs) {
+		return "", "", errors.New("creator msp " + creator.Mspid + " is not trusted for chaincode " + chaincode)
+	}
+
+	return chaincode, creator.Mspid, nil
+}
+
+func (t *OceanChaincode) getHold(stub shim.ChaincodeStubInterface, holdID string) (*Hold, error) {
+	holdBytes, err := stub.GetState(HoldPrefix + holdID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(holdBytes) == 0 {
+		return nil, errors.New("hold not exist")
+	}
+
+	hold := &Hold{}
+	err = json.Unmarshal(holdBytes, hold)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return hold, nil
+}
+
+func (t *OceanChaincode) putHold(stub shim.ChaincodeStubInterface, hold *Hold) ([]byte, error) {
+	holdJson, err := json.Marshal(hold)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return holdJson, stub.PutState(HoldPrefix+hold.HoldID, holdJson)
+}
+
+// args: address, tokenID
+func (t *OceanChaincode) balanceOf(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("incorrect number of args")
+	}
+
+	balance, err := t.getTokenBalance(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(balance.String()))
+}
+
+// args: holdID, address, tokenID, number[, pubKey, payload hex of Hold, sign]
+func (t *OceanChaincode) hold(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 && len(args) != 7 {
+		return shim.Error("incorrect number of args")
+	}
+
+	hold := Hold{
+		HoldID:  args[0],
+		Address: args[1],
+		TokenID: args[2],
+		Number:  args[3],
+		Status:  HoldHeld,
+	}
+
+	if hold.HoldID == "" {
+		return shim.Error("holdID is null")
+	}
+
+	if !IsGtZeroInteger(hold.Number) {
+		return shim.Error("number need to be greater than 0 integer")
+	}
+
+	token, err := t.getToken(stub, hold.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if token.Collection != "" {
+		return shim.Error("private token can not be held")
+	}
+
+	hold.Chaincode, hold.Creator, err = t.checkCaller(stub, hold.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.checkNotRetired(stub, hold.Address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	holdBytes, err := stub.GetState(HoldPrefix + hold.HoldID)
+	if len(holdBytes) != 0 {
+		return shim.Error("hold already existed")
+	}
+
+	number, _ := new(big.Int).SetString(hold.Number, 10)
+
+	if len(args) == 7 {
+		signed := Hold{}
+		address, err := verifyPayload(stub, "hold", args[4], args[5], args[6], &signed)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if address != hold.Address {
+			return shim.Error("address and public key not match")
+		}
+
+		if signed.HoldID != hold.HoldID || signed.TokenID != hold.TokenID || signed.Number != hold.Number || signed.Chaincode != hold.Chaincode {
+			return shim.Error("signed hold does not match args")
+		}
+	} else {
+		auth, err := t.getCallerAuthorization(stub, hold.Address, hold.TokenID, hold.Chaincode)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if auth == nil {
+			return shim.Error("chaincode " + hold.Chaincode + " is not authorized by " + hold.Address)
+		}
+
+		allowance, _ := new(big.Int).SetString(auth.Allowance, 10)
+		if allowance.Cmp(number) < 0 {
+			return shim.Error("allowance " + auth.Allowance + " less than number " + hold.Number)
+		}
+
+		auth.Allowance = allowance.Sub(allowance, number).String()
+		_, err = t.putCallerAuthorization(stub, auth)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	balance, err := t.getTokenBalance(stub, hold.Address, hold.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if balance.Cmp(number) < 0 {
+		return shim.Error("balance of address " + balance.String() + " less than " + "number " + hold.Number)
+	}
+
+	err = t.checkSpendingLimit(stub, hold.Address, hold.TokenID, hold.Number, "", nil)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	holdJson, err := t.putHold(stub, &hold)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putWalletEntry(stub, "", hold.Address, hold.TokenID, "-", hold.Number, "hold:"+hold.HoldID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "Hold",
+		Ref:     hold.HoldID,
+		TokenID: hold.TokenID,
+		From:    hold.Address,
+		Number:  hold.Number,
+		Data:    holdJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(holdJson)
+}
+
+// closeHold loads an open hold and checks it belongs to the calling chaincode.
+func (t *OceanChaincode) closeHold(stub shim.ChaincodeStubInterface, holdID string) (*Hold, error) {
+	hold, err := t.getHold(stub, holdID)
+	if err != nil {
+		return nil, err
+	}
+
+	if hold.Status != HoldHeld {
+		return nil, errors.New("hold is " + hold.Status)
+	}
+
+	chaincode, _, err := t.checkCaller(stub, hold.TokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	if chaincode != hold.Chaincode {
+		return nil, errors.New("hold belongs to chaincode " + hold.Chaincode)
+	}
+
+	return hold, nil
+}
+
+// args: holdID, toAddress
+func (t *OceanChaincode) settle(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("incorrect number of args")
+	}
+
+	hold, err := t.closeHold(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	toAddress := args[1]
+	if !IsValidAddress(toAddress) {
+		return shim.Error("toAddress is invalid")
+	}
+
+	err = t.checkNotRetired(stub, toAddress)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	hold.Status = HoldSettled
+	hold.SettledTo = toAddress
+
+	holdJson, err := t.putHold(stub, hold)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putWalletEntry(stub, "", toAddress, hold.TokenID, "+", hold.Number, "settle:"+hold.HoldID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "Settle",
+		Ref:     hold.HoldID,
+		TokenID: hold.TokenID,
+		From:    hold.Address,
+		To:      toAddress,
+		Number:  hold.Number,
+		Data:    holdJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(holdJson)
+}
+
+// args: holdID
+func (t *OceanChaincode) release(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("incorrect number of args")
+	}
+
+	hold, err := t.closeHold(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	hold.Status = HoldReleased
+
+	holdJson, err := t.putHold(stub, hold)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putWalletEntry(stub, "", hold.Address, hold.TokenID, "+", hold.Number, "release:"+hold.HoldID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "Release",
+		Ref:     hold.HoldID,
+		TokenID: hold.TokenID,
+		To:      hold.Address,
+		Number:  hold.Number,
+		Data:    holdJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(holdJson)
+}
+
+// args: holdID
+func (t *OceanChaincode) queryHold(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	holdBytes, err := stub.GetState(HoldPrefix + args[0])
+	if len(holdBytes) == 0 || err != nil {
+		res.Msg = "hold not exist"
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = holdBytes
+	return t.response(res)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	EventPrefix  = "ocean."
+	EventVersion = 1
+)
+
+// Event is the JSON payload of every chaincode event, named EventPrefix +
+// Action. Ref is the business identifier of the action (transfer txID,
+// snapshotID, proposalID, ...), TxID is always the Fabric transaction ID.
+// Action specific fields go in Data. Fabric keeps only one event per
+// transaction, so operations touching several transfers emit a single
+// event carrying the others in Events.
+type Event struct {
+	Version int             `json:"version"`
+	Action  string          `json:"action"`
+	TxID    string          `json:"txID"`
+	Ref     string          `json:"ref,omitempty"`
+	TokenID string          `json:"tokenID,omitempty"`
+	From    string          `json:"from,omitempty"`
+	To      string          `json:"to,omitempty"`
+	Number  string          `json:"number,omitempty"`
+	Memo    string          `json:"memo,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Events  []*Event        `json:"events,omitempty"`
+}
+
+func (t *OceanChaincode) emitEvent(stub shim.ChaincodeStubInterface, event *Event) error {
+	event.Version = EventVersion
+	event.TxID = stub.GetTxID()
+	for _, e := range event.Events {
+		e.Version = EventVersion
+		e.TxID = event.TxID
+	}
+
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return stub.SetEvent(EventPrefix+event.Action, eventJson)
+}
@@ -31,6 +31,12 @@ func (t *OceanChaincode) initValue(stub shim.ChaincodeStubInterface, args []stri
 		logger.Error(err)
 		return shim.Error(err.Error())
 	}
+
+	err = t.emitEvent(stub, &Event{Action: "InitValue", To: toAddr, Number: strconv.Itoa(toAddrVal)})
+	if err != nil {
+		logger.Error(err)
+		return shim.Error(err.Error())
+	}
 	logger.Info("initValue end")
 
 	return shim.Success(nil)
@@ -95,6 +101,12 @@ func (t *OceanChaincode) move(stub shim.ChaincodeStubInterface, args []string) p
 		return shim.Error(err.Error())
 	}
 
+	err = t.emitEvent(stub, &Event{Action: "Move", From: fromAddr, To: toAddr, Number: strconv.Itoa(num)})
+	if err != nil {
+		logger.Error(err)
+		return shim.Error(err.Error())
+	}
+
 	return shim.Success(nil)
 }
 
@@ -116,6 +128,12 @@ func (t *OceanChaincode) delete(stub shim.ChaincodeStubInterface, args []string)
 		return shim.Error("Failed to delete state")
 	}
 
+	err = t.emitEvent(stub, &Event{Action: "Delete", From: A})
+	if err != nil {
+		logger.Error(err)
+		return shim.Error(err.Error())
+	}
+
 	return shim.Success(nil)
 }
 
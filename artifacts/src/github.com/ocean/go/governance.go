@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	ProposalOpen   = "open"
+	ProposalClosed = "closed"
+)
+
+// Proposal is a token-weighted vote. Voting weight is the voter's balance of
+// TokenID at SnapshotSequence, the snapshot taken when the proposal was
+// created.
+type Proposal struct {
+	ProposalID       string          `json:"proposalID"`
+	TokenID          string          `json:"tokenID"`
+	Title            string          `json:"title"`
+	Options          []string        `json:"options"`
+	StartTime        int64           `json:"startTime"`
+	EndTime          int64           `json:"endTime"`
+	Quorum           string          `json:"quorum"`
+	Proposer         string          `json:"proposer"`
+	SnapshotSequence int64           `json:"snapshotSequence"`
+	Status           string          `json:"status"`
+	Result           *ProposalResult `json:"result,omitempty"`
+}
+
+type ProposalResult struct {
+	Tallies     []string `json:"tallies"`
+	TotalWeight string   `json:"totalWeight"`
+	QuorumMet   bool     `json:"quorumMet"`
+	Winner      string   `json:"winner"`
+}
+
+type Vote struct {
+	ProposalID string `json:"proposalID"`
+	Voter      string `json:"voter"`
+	Option     string `json:"option"`
+	Weight     string `json:"weight"`
+}
+
+func (t *OceanChaincode) getProposal(stub shim.ChaincodeStubInterface, proposalID string) (*Proposal, error) {
+	proposalBytes, err := stub.GetState(ProposalPrefix + proposalID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(proposalBytes) == 0 {
+		return nil, errors.New("proposal not exist")
+	}
+
+	proposal := &Proposal{}
+	err = json.Unmarshal(proposalBytes, proposal)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return proposal, nil
+}
+
+func (t *OceanChaincode) putProposal(stub shim.ChaincodeStubInterface, proposal *Proposal) ([]byte, error) {
+	proposalJson, err := json.Marshal(proposal)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return proposalJson, stub.PutState(ProposalPrefix+proposal.ProposalID, proposalJson)
+}
+
+// args: pubKey, payload hex of Proposal{proposalID, tokenID, title, options, startTime, endTime, quorum}, sign
+func (t *OceanChaincode) createProposal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	proposal := Proposal{}
+	address, err := verifyPayload(stub, "createProposal", args[0], args[1], args[2], &proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if proposal.ProposalID == "" || proposal.TokenID == "" {
+		return shim.Error("proposalID or tokenID is null string")
+	}
+
+	if len(proposal.Options) < 2 {
+		return shim.Error("proposal need at least 2 options")
+	}
+
+	seen := make(map[string]bool)
+	for _, option := range proposal.Options {
+		if option == "" || seen[option] {
+			return shim.Error("options must be unique and not null")
+		}
+		seen[option] = true
+	}
+
+	if proposal.EndTime <= proposal.StartTime {
+		return shim.Error("endTime need to be greater than startTime")
+	}
+
+	if _, success := new(big.Int).SetString(proposal.Quorum, 10); !success || proposal.Quorum[0] == '-' {
+		return shim.Error("quorum need to be a non-negative integer")
+	}
+
+	_, err = t.getToken(stub, proposal.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	proposalBytes, err := stub.GetState(ProposalPrefix + proposal.ProposalID)
+	if len(proposalBytes) != 0 {
+		return shim.Error("proposal already existed")
+	}
+
+	sequence, err := nextSnapshotSequence(stub, proposal.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	balance, err := t.getBalanceAt(stub, address, proposal.TokenID, sequence)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if balance.Sign() <= 0 {
+		return shim.Error("proposer does not hold token " + proposal.TokenID)
+	}
+
+	proposal.Proposer = address
+	proposal.SnapshotSequence = sequence
+	proposal.Status = ProposalOpen
+	proposal.Result = nil
+
+	proposalJson, err := t.putProposal(stub, &proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "CreateProposal",
+		Ref:     proposal.ProposalID,
+		TokenID: proposal.TokenID,
+		From:    address,
+		Data:    proposalJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: pubKey, payload hex of Vote{proposalID, option}, sign
+func (t *OceanChaincode) castVote(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	vote := Vote{}
+	address, err := verifyPayload(stub, "castVote", args[0], args[1], args[2], &vote)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	proposal, err := t.getProposal(stub, vote.ProposalID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.checkNotRetired(stub, address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if proposal.Status != ProposalOpen {
+		return shim.Error("proposal is " + proposal.Status)
+	}
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now/int64(time.Second) < proposal.StartTime || now/int64(time.Second) >= proposal.EndTime {
+		return shim.Error("proposal is not in voting window")
+	}
+
+	valid := false
+	for _, option := range proposal.Options {
+		if option == vote.Option {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		return shim.Error("option not exist: " + vote.Option)
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(VotePrefix, []string{proposal.ProposalID, address})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	voteBytes, err := stub.GetState(compositeKey)
+	if len(voteBytes) != 0 {
+		return shim.Error("address already voted")
+	}
+
+	weight, err := t.getBalanceAt(stub, address, proposal.TokenID, proposal.SnapshotSequence)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if weight.Sign() <= 0 {
+		return shim.Error("address has no voting weight at proposal snapshot")
+	}
+
+	vote.Voter = address
+	vote.Weight = weight.String()
+
+	voteJson, err := json.Marshal(&vote)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, voteJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "CastVote",
+		Ref:     proposal.ProposalID,
+		TokenID: proposal.TokenID,
+		From:    address,
+		Number:  vote.Weight,
+		Data:    voteJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: proposalID
+func (t *OceanChaincode) tallyProposal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("incorrect number of args")
+	}
+
+	proposal, err := t.getProposal(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if proposal.Status != ProposalOpen {
+		return shim.Error("proposal is " + proposal.Status)
+	}
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now/int64(time.Second) < proposal.EndTime {
+		return shim.Error("voting window not ended")
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(VotePrefix, []string{proposal.ProposalID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer iterator.Close()
+
+	tallies := make([]*big.Int, len(proposal.Options))
+	for i := range tallies {
+		tallies[i] = big.NewInt(0)
+	}
+	total := big.NewInt(0)
+
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		vote := Vote{}
+		err = json.Unmarshal(responseRange.Value, &vote)
+		if err != nil {
+			return shim.Error("json unmarshal fail")
+		}
+
+		weight, success := new(big.Int).SetString(vote.Weight, 10)
+		if !success {
+			return shim.Error("weight not match: " + vote.Weight)
+		}
+
+		for i, option := range proposal.Options {
+			if option == vote.Option {
+				tallies[i].Add(tallies[i], weight)
+				break
+			}
+		}
+		total.Add(total, weight)
+	}
+
+	quorum, _ := new(big.Int).SetString(proposal.Quorum, 10)
+
+	result := &ProposalResult{
+		TotalWeight: total.String(),
+		QuorumMet:   total.Cmp(quorum) >= 0,
+	}
+
+	// The winner is the option with strictly the highest weight; a tie or a
+	// missed quorum leaves it empty.
+	best := -1
+	tie := false
+	for i, tally := range tallies {
+		result.Tallies = append(result.Tallies, tally.String())
+		if best < 0 || tally.Cmp(tallies[best]) > 0 {
+			best = i
+			tie = false
+		} else if tally.Cmp(tallies[best]) == 0 {
+			tie = true
+		}
+	}
+
+	if result.QuorumMet && !tie && tallies[best].Sign() > 0 {
+		result.Winner = proposal.Options[best]
+	}
+
+	proposal.Status = ProposalClosed
+	proposal.Result = result
+
+	proposalJson, err := t.putProposal(stub, proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "TallyProposal",
+		Ref:     proposal.ProposalID,
+		TokenID: proposal.TokenID,
+		Data:    proposalJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(proposalJson)
+}
+
+// args: proposalID
+func (t *OceanChaincode) queryProposal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	proposal, err := t.getProposal(stub, args[0])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	proposalData, err := json.Marshal(proposal)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = proposalData
+	return t.response(res)
+}
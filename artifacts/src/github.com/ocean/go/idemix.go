@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/idemix"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Holders of an Idemix credential from the issuer configured in state own
+// balances under pseudonym addresses, NymAddressPrefix and the first 20
+// bytes, in hex, of the sha256 of the pseudonym point. A transfer from a
+// pseudonym carries an Idemix signature over the payload that discloses no
+// attribute: it proves a valid, unrevoked credential and the secret key
+// behind the pseudonym without linking it to any other pseudonym of the
+// holder.
+
+const (
+	NymAddressPrefix = "nym:"
+	nymAddressLength = 40
+)
+
+type IdemixConfig struct {
+	IssuerPublicKey     string `json:"issuerPublicKey"`
+	RevocationPublicKey string `json:"revocationPublicKey"`
+	RhIndex             int    `json:"rhIndex"`
+	Epoch               int    `json:"epoch"`
+}
+
+// GetNymAddress returns the address owned by the pseudonym nym.
+func GetNymAddress(nym *idemix.ECP) string {
+	hash := sha256.New()
+	hash.Write(nym.GetX())
+	hash.Write(nym.GetY())
+
+	return NymAddressPrefix + hex.EncodeToString(hash.Sum(nil))[:nymAddressLength]
+}
+
+func IsNymAddress(addr string) bool {
+	if !strings.HasPrefix(addr, NymAddressPrefix) {
+		return false
+	}
+
+	digest := addr[len(NymAddressPrefix):]
+	if len(digest) != nymAddressLength || strings.ToLower(digest) != digest {
+		return false
+	}
+
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
+
+// parseIdemixConfig decodes and checks the issuer and revocation public keys.
+func parseIdemixConfig(config *IdemixConfig) (*idemix.IssuerPublicKey, *ecdsa.PublicKey, error) {
+	ipkBytes, err := hex.DecodeString(config.IssuerPublicKey)
+	if err != nil {
+		return nil, nil, errors.New("issuerPublicKey decode fail")
+	}
+
+	ipk := &idemix.IssuerPublicKey{}
+	err = proto.Unmarshal(ipkBytes, ipk)
+	if err != nil {
+		return nil, nil, errors.New("issuerPublicKey unmarshal fail")
+	}
+
+	err = ipk.Check()
+	if err != nil {
+		return nil, nil, errors.New("issuerPublicKey invalid: " + err.Error())
+	}
+
+	if config.RhIndex < 0 || config.RhIndex >= len(ipk.AttributeNames) {
+		return nil, nil, errors.New("rhIndex out of attribute range")
+	}
+
+	block, _ := pem.Decode([]byte(config.RevocationPublicKey))
+	if block == nil {
+		return nil, nil, errors.New("revocationPublicKey decode fail")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, nil, errors.New("revocationPublicKey parse fail: " + err.Error())
+	}
+
+	revPk, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, nil, errors.New("revocationPublicKey is not an ecdsa key")
+	}
+
+	return ipk, revPk, nil
+}
+
+func (t *OceanChaincode) getIdemixConfig(stub shim.ChaincodeStubInterface) (*IdemixConfig, error) {
+	configBytes, err := stub.GetState(IdemixConfigKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(configBytes) == 0 {
+		return nil, errors.New("idemix not configured")
+	}
+
+	config := &IdemixConfig{}
+	err = json.Unmarshal(configBytes, config)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return config, nil
+}
+
+// verifyNymSignature checks sigHex, an Idemix signature over payloadHex
+// disclosing no attribute, and returns the pseudonym address it signs for.
+func (t *OceanChaincode) verifyNymSignature(stub shim.ChaincodeStubInterface, payloadHex, sigHex string) (string, error) {
+	config, err := t.getIdemixConfig(stub)
+	if err != nil {
+		return "", err
+	}
+
+	ipk, revPk, err := parseIdemixConfig(config)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := hex.DecodeString(payloadHex)
+	if err != nil {
+		return "", err
+	}
+
+	sigBytes, err := hex.DecodeString(sigHex)
+	if err != nil {
+		return "", err
+	}
+
+	sig := &idemix.Signature{}
+	err = proto.Unmarshal(sigBytes, sig)
+	if err != nil {
+		return "", errors.New("idemix signature unmarshal fail")
+	}
+
+	if sig.GetNym() == nil || sig.GetNonRevocationProof() == nil {
+		return "", errors.New("idemix signature incomplete")
+	}
+
+	disclosure := make([]byte, len(ipk.AttributeNames))
+	err = sig.Ver(disclosure, ipk, payload, nil, config.RhIndex, revPk, config.Epoch)
+	if err != nil {
+		return "", errors.New("idemix signature verify fail: " + err.Error())
+	}
+
+	return GetNymAddress(sig.GetNym()), nil
+}
+
+// args: IdemixConfig json{issuerPublicKey hex, revocationPublicKey pem, rhIndex, epoch}
+func (t *OceanChaincode) configureIdemix(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("incorrect number of args")
+	}
+
+	config := IdemixConfig{}
+	err := json.Unmarshal([]byte(args[0]), &config)
+	if err != nil {
+		return shim.Error("json unmarshal fail")
+	}
+
+	_, _, err = parseIdemixConfig(&config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	configJson, err := json.Marshal(&config)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(IdemixConfigKey, configJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{Action: "ConfigureIdemix", Data: configJson})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: txID, payload hex of Transfer{fromAddress, toAddress, tokenID, number, txID, memo}, idemix signature hex
+// fromAddress is the pseudonym address of the signature, txID must match args
+func (t *OceanChaincode) transferAnonymous(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	txID := args[0]
+	if txID == "" {
+		return shim.Error("txID is null")
+	}
+
+	address, err := t.verifyNymSignature(stub, args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	transferJson, err := hex.DecodeString(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tx := Transfer{}
+	err = json.Unmarshal(transferJson, &tx)
+	if err != nil {
+		return shim.Error("json unmarshal fail")
+	}
+
+	if address != tx.FromAddress {
+		return shim.Error("fromAddress and pseudonym not match")
+	}
+
+	// the signature must not be replayable under another txID
+	if tx.TxID != txID {
+		return shim.Error("txID and payload not match")
+	}
+
+	return t.executeTransfer(stub, txID, &tx, "", nil)
+}
+
+// args: payload hex, idemix signature hex over payload hex
+// returns the pseudonym address a signature is valid for
+func (t *OceanChaincode) queryNymAddress(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	address, err := t.verifyNymSignature(stub, args[0], args[1])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = []byte(address)
+	return t.response(res)
+}
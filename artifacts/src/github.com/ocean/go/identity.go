@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	"github.com/hyperledger/fabric/protos/utils"
+)
+
+// getCreator returns the identity that submitted the proposal.
+func getCreator(stub shim.ChaincodeStubInterface) (*msp.SerializedIdentity, error) {
+	creator, err := stub.GetCreator()
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &msp.SerializedIdentity{}
+	err = proto.Unmarshal(creator, identity)
+	if err != nil {
+		return nil, errors.New("creator unmarshal fail: " + err.Error())
+	}
+
+	return identity, nil
+}
+
+// getCallerChaincode returns the name of the chaincode the client proposal
+// was addressed to. When another chaincode reaches us through
+// InvokeChaincode, that is the calling chaincode, not this one.
+func getCallerChaincode(stub shim.ChaincodeStubInterface) (string, error) {
+	signedProposal, err := stub.GetSignedProposal()
+	if err != nil {
+		return "", err
+	}
+
+	if signedProposal == nil {
+		return "", errors.New("signed proposal is nil")
+	}
+
+	proposal, err := utils.GetProposal(signedProposal.ProposalBytes)
+	if err != nil {
+		return "", err
+	}
+
+	cis, err := utils.GetChaincodeInvocationSpec(proposal)
+	if err != nil {
+		return "", err
+	}
+
+	if cis.ChaincodeSpec == nil || cis.ChaincodeSpec.ChaincodeId == nil {
+		return "", errors.New("chaincode spec is nil")
+	}
+
+	return cis.ChaincodeSpec.ChaincodeId.Name, nil
+}
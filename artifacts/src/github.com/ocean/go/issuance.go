@@ -0,0 +1,676 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// An issuance policy makes issueToken and mint of a token class wait for
+// Threshold of its approving organizations. Only classes an admin bound a
+// policy to can be issued; a policy without approvers lets the class issue
+// at once, and tokens without a class fall under the policy of the empty
+// class when an admin set one. The request is kept under
+// IssuanceRequestPrefix with a copy of the policy. An organization approves
+// by invoking approveIssuance with one of its identities, or by its
+// registered Signer signing the request together with the transaction that
+// made it, so they do not carry over to a request made again under the same
+// ID; such signatures may also come with the original call. The request takes effect in the transaction reaching
+// the threshold and expires TTL seconds after it was made.
+
+const (
+	IssuanceIssue = "issue"
+	IssuanceMint  = "mint"
+
+	IssuancePending  = "pending"
+	IssuanceExecuted = "executed"
+	IssuanceExpired  = "expired"
+)
+
+type OrgApprover struct {
+	MSPID  string `json:"mspID"`
+	Signer string `json:"signer,omitempty"`
+}
+
+type IssuancePolicy struct {
+	Class     string         `json:"class"`
+	Approvers []*OrgApprover `json:"approvers"`
+	Threshold int            `json:"threshold"`
+	TTL       int64          `json:"ttl"`
+	Remove    bool           `json:"remove,omitempty"`
+}
+
+type IssuanceApproval struct {
+	MSPID  string `json:"mspID"`
+	Signer string `json:"signer,omitempty"`
+	TxID   string `json:"txID"`
+}
+
+type IssuanceRequest struct {
+	RequestID string              `json:"requestID"`
+	Kind      string              `json:"kind"`
+	TokenID   string              `json:"tokenID"`
+	Payload   string              `json:"payload"`
+	TxID      string              `json:"txID"`
+	Requester string              `json:"requester,omitempty"`
+	Policy    *IssuancePolicy     `json:"policy"`
+	Approvals []*IssuanceApproval `json:"approvals"`
+	ExpiresAt int64               `json:"expiresAt"`
+	Status    string              `json:"status"`
+}
+
+type Mint struct {
+	TokenID string `json:"tokenID"`
+	Number  string `json:"number"`
+	Serial  string `json:"serial"`
+	Memo    string `json:"memo,omitempty"`
+}
+
+// ApprovedIssuance is what the signer of a SignatureApproval signs, as hex
+// of its JSON, so the signature only approves that request as made by the
+// transaction TxID.
+type ApprovedIssuance struct {
+	RequestID string `json:"requestID"`
+	Kind      string `json:"kind"`
+	Payload   string `json:"payload"`
+	TxID      string `json:"txID"`
+}
+
+// SignatureApproval is a signature of an approver over ApprovedIssuance.
+type SignatureApproval struct {
+	PubKey string `json:"pubKey"`
+	Sign   string `json:"sign"`
+}
+
+func (t *OceanChaincode) getIssuancePolicy(stub shim.ChaincodeStubInterface, class string) (*IssuancePolicy, error) {
+	policyBytes, err := stub.GetState(IssuancePolicyPrefix + class)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(policyBytes) == 0 {
+		return nil, nil
+	}
+
+	policy := &IssuancePolicy{}
+	err = json.Unmarshal(policyBytes, policy)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return policy, nil
+}
+
+// classPolicy returns the policy of class, failing for a class no admin
+// bound. It returns nil for a token without a class while the empty class
+// has no policy.
+func (t *OceanChaincode) classPolicy(stub shim.ChaincodeStubInterface, class string) (*IssuancePolicy, error) {
+	policy, err := t.getIssuancePolicy(stub, class)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy == nil && class != "" {
+		return nil, errors.New("issuance class " + class + " is not bound by admin")
+	}
+
+	return policy, nil
+}
+
+func (t *OceanChaincode) getIssuanceRequest(stub shim.ChaincodeStubInterface, requestID string) (*IssuanceRequest, error) {
+	requestBytes, err := stub.GetState(IssuanceRequestPrefix + requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(requestBytes) == 0 {
+		return nil, errors.New("issuance request not exist")
+	}
+
+	request := &IssuanceRequest{}
+	err = json.Unmarshal(requestBytes, request)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return request, nil
+}
+
+func (t *OceanChaincode) putIssuanceRequest(stub shim.ChaincodeStubInterface, request *IssuanceRequest) ([]byte, error) {
+	requestJson, err := json.Marshal(request)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return requestJson, stub.PutState(IssuanceRequestPrefix+request.RequestID, requestJson)
+}
+
+func (request *IssuanceRequest) approvedBy(mspID string) bool {
+	for _, approval := range request.Approvals {
+		if approval.MSPID == mspID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// approve records the approval of mspID, reporting whether it is new.
+func (request *IssuanceRequest) approve(mspID, signer, txID string) bool {
+	if request.approvedBy(mspID) {
+		return false
+	}
+
+	for _, approver := range request.Policy.Approvers {
+		if approver.MSPID == mspID {
+			request.Approvals = append(request.Approvals, &IssuanceApproval{MSPID: mspID, Signer: signer, TxID: txID})
+			return true
+		}
+	}
+
+	return false
+}
+
+// approvalHex returns the hex of the ApprovedIssuance signers of request sign.
+func (request *IssuanceRequest) approvalHex() (string, error) {
+	approvedJson, err := json.Marshal(&ApprovedIssuance{
+		RequestID: request.RequestID,
+		Kind:      request.Kind,
+		Payload:   request.Payload,
+		TxID:      request.TxID,
+	})
+	if err != nil {
+		return "", errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return hex.EncodeToString(approvedJson), nil
+}
+
+// addApprovals records the creator's organization, when it is an approver,
+// and the organizations whose signers signed the request in approvalsJson.
+// It fails if nothing new was approved.
+func (t *OceanChaincode) addApprovals(stub shim.ChaincodeStubInterface, request *IssuanceRequest, approvalsJson string) error {
+	added := false
+
+	creator, err := getCreator(stub)
+	if err == nil && request.approve(creator.Mspid, "", stub.GetTxID()) {
+		added = true
+	}
+
+	if approvalsJson != "" {
+		var approvals []*SignatureApproval
+		err = json.Unmarshal([]byte(approvalsJson), &approvals)
+		if err != nil {
+			return errors.New("json unmarshal fail")
+		}
+
+		approvedHex, err := request.approvalHex()
+		if err != nil {
+			return err
+		}
+
+		for _, approval := range approvals {
+			verify, err := Verify(approval.PubKey, approvedHex, approval.Sign)
+			if err != nil || !verify {
+				return errors.New("approval verify fail")
+			}
+
+			signer := GetAddress(approval.PubKey)
+			matched := false
+			for _, approver := range request.Policy.Approvers {
+				if approver.Signer != "" && approver.Signer == signer {
+					matched = true
+					if request.approve(approver.MSPID, signer, stub.GetTxID()) {
+						added = true
+					}
+				}
+			}
+
+			if !matched {
+				return errors.New("signer " + signer + " is not an approver")
+			}
+		}
+	}
+
+	if !added {
+		return errors.New("no new approval of an approving organization")
+	}
+
+	return nil
+}
+
+// requestIssuance executes an issuance at once when its class needs no
+// approval, otherwise it opens a request and executes it if approvalsJson already
+// reaches the threshold. The request is kept either way, so a signed payload
+// cannot be replayed.
+func (t *OceanChaincode) requestIssuance(stub shim.ChaincodeStubInterface, kind, requestID, tokenID, class, payloadHex string, approvals []string) pb.Response {
+	request := &IssuanceRequest{
+		RequestID: requestID,
+		Kind:      kind,
+		TokenID:   tokenID,
+		Payload:   payloadHex,
+		TxID:      stub.GetTxID(),
+		Status:    IssuancePending,
+	}
+
+	creator, err := getCreator(stub)
+	if err == nil {
+		request.Requester = creator.Mspid
+	}
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now = now / int64(time.Second)
+
+	// a request is only made again once the previous one expired
+	current, err := t.getIssuanceRequest(stub, requestID)
+	if err == nil && current.Status != IssuanceExpired && (current.Status != IssuancePending || now < current.ExpiresAt) {
+		return shim.Error("issuance request " + requestID + " already " + current.Status)
+	}
+
+	policy, err := t.classPolicy(stub, class)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if policy == nil || len(policy.Approvers) == 0 {
+		event, err := t.executeIssuance(stub, request)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		request.Status = IssuanceExecuted
+		_, err = t.putIssuanceRequest(stub, request)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = t.emitEvent(stub, event)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		return shim.Success(nil)
+	}
+
+	request.Policy = policy
+	request.ExpiresAt = now + policy.TTL
+
+	approvalsJson := ""
+	if len(approvals) != 0 {
+		approvalsJson = approvals[0]
+	}
+
+	// the request stands even if its caller's organization cannot approve
+	err = t.addApprovals(stub, request, approvalsJson)
+	if err != nil && approvalsJson != "" {
+		return shim.Error(err.Error())
+	}
+
+	return t.advanceIssuance(stub, request)
+}
+
+// advanceIssuance executes request once it has enough approvals and stores it.
+// The event of the request carries the event of the execution.
+func (t *OceanChaincode) advanceIssuance(stub shim.ChaincodeStubInterface, request *IssuanceRequest) pb.Response {
+	var events []*Event
+	if len(request.Approvals) >= request.Policy.Threshold {
+		event, err := t.executeIssuance(stub, request)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		request.Status = IssuanceExecuted
+		events = append(events, event)
+	}
+
+	requestJson, err := t.putIssuanceRequest(stub, request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "IssuanceRequest",
+		Ref:     request.RequestID,
+		TokenID: request.TokenID,
+		Data:    requestJson,
+		Events:  events,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(requestJson)
+}
+
+// executeIssuance issues or mints what request asks for and returns the event
+// of it.
+func (t *OceanChaincode) executeIssuance(stub shim.ChaincodeStubInterface, request *IssuanceRequest) (*Event, error) {
+	payload, err := hex.DecodeString(request.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Kind == IssuanceMint {
+		mint := Mint{}
+		err = json.Unmarshal(payload, &mint)
+		if err != nil {
+			return nil, errors.New("json unmarshal fail")
+		}
+
+		token, err := t.getToken(stub, mint.TokenID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = t.chargeIssuanceQuotas(stub, request, token.Address, mint.Number)
+		if err != nil {
+			return nil, err
+		}
+
+		return t.mintToken(stub, &mint)
+	}
+
+	token := Token{}
+	err = json.Unmarshal(payload, &token)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	err = t.chargeIssuanceQuotas(stub, request, token.Address, token.TotalNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	// the payload also carries the action and nonce it was signed with
+	tokenJson, err := json.Marshal(&token)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return t.createToken(stub, request.TokenID, &token, tokenJson)
+}
+
+// mintToken credits number new tokens to the issuer and returns the event of
+// the mint.
+func (t *OceanChaincode) mintToken(stub shim.ChaincodeStubInterface, mint *Mint) (*Event, error) {
+	token, err := t.getToken(stub, mint.TokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	totalNumber, _ := new(big.Int).SetString(token.TotalNumber, 10)
+	number, _ := new(big.Int).SetString(mint.Number, 10)
+	token.TotalNumber = totalNumber.Add(totalNumber, number).String()
+
+	tokenJson, err := json.Marshal(token)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	err = t.putToken(stub, mint.TokenID, tokenJson)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.putTokenWalletEntry(stub, token, token.Collection, token.Address, mint.TokenID, "+", mint.Number, "mint:"+mint.Serial)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Event{
+		Action:  "Mint",
+		Ref:     mint.Serial,
+		TokenID: mint.TokenID,
+		To:      token.Address,
+		Number:  mint.Number,
+		Memo:    mint.Memo,
+	}, nil
+}
+
+// args: issuer pubKey, payload hex of Mint{tokenID, number, serial, memo}, sign[, approvals json of SignatureApproval list]
+func (t *OceanChaincode) mint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("incorrect number of args")
+	}
+
+	mint := Mint{}
+	address, err := verifyPayload(stub, "mint", args[0], args[1], args[2], &mint)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	token, err := t.getToken(stub, mint.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if isLPToken(mint.TokenID) {
+		return shim.Error("LP token is only minted by its pool")
+	}
+
+	if address != token.Address {
+		return shim.Error("only token issuer can mint")
+	}
+
+	if token.Confidential {
+		return shim.Error("supply of confidential token is fixed")
+	}
+
+	if token.Origin != nil {
+		return shim.Error("wrapped token is minted by bridge only")
+	}
+
+	if mint.Serial == "" {
+		return shim.Error("serial is null")
+	}
+
+	if !IsGtZeroInteger(mint.Number) {
+		return shim.Error("number need to be greater than 0 integer")
+	}
+
+	return t.requestIssuance(stub, IssuanceMint, IssuanceMint+":"+mint.TokenID+":"+mint.Serial, mint.TokenID, token.Class, args[1], args[3:])
+}
+
+// args: requestID[, approvals json of SignatureApproval list]
+func (t *OceanChaincode) approveIssuance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("incorrect number of args")
+	}
+
+	request, err := t.getIssuanceRequest(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if request.Status != IssuancePending {
+		return shim.Error("issuance request is " + request.Status)
+	}
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now/int64(time.Second) >= request.ExpiresAt {
+		return shim.Error("issuance request expired")
+	}
+
+	approvalsJson := ""
+	if len(args) == 2 {
+		approvalsJson = args[1]
+	}
+
+	err = t.addApprovals(stub, request, approvalsJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return t.advanceIssuance(stub, request)
+}
+
+// args: requestID
+// marks a pending request expired once its TTL passed
+func (t *OceanChaincode) expireIssuance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("incorrect number of args")
+	}
+
+	request, err := t.getIssuanceRequest(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if request.Status != IssuancePending {
+		return shim.Error("issuance request is " + request.Status)
+	}
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now/int64(time.Second) < request.ExpiresAt {
+		return shim.Error("issuance request expires at " + strconv.FormatInt(request.ExpiresAt, 10))
+	}
+
+	request.Status = IssuanceExpired
+
+	requestJson, err := t.putIssuanceRequest(stub, request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "ExpireIssuance",
+		Ref:     request.RequestID,
+		TokenID: request.TokenID,
+		Data:    requestJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: IssuancePolicy json{class, approvers, threshold, ttl, remove}
+// binds the class to the policy, a policy without approvers lets it issue at once
+func (t *OceanChaincode) setIssuancePolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("incorrect number of args")
+	}
+
+	policy := IssuancePolicy{}
+	err := json.Unmarshal([]byte(args[0]), &policy)
+	if err != nil {
+		return shim.Error("json unmarshal fail")
+	}
+
+	seen := make(map[string]bool)
+	for _, approver := range policy.Approvers {
+		if approver.MSPID == "" || seen[approver.MSPID] {
+			return shim.Error("approvers must be unique MSP IDs")
+		}
+		seen[approver.MSPID] = true
+
+		if approver.Signer != "" && !IsValidAddress(approver.Signer) {
+			return shim.Error("signer is invalid: " + approver.Signer)
+		}
+	}
+
+	if len(policy.Approvers) != 0 && (policy.Threshold < 1 || policy.Threshold > len(policy.Approvers)) {
+		return shim.Error("threshold need to be between 1 and number of approvers")
+	}
+
+	if len(policy.Approvers) != 0 && policy.TTL <= 0 {
+		return shim.Error("ttl need to be greater than 0")
+	}
+
+	policyJson, err := json.Marshal(&policy)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	if policy.Remove {
+		err = stub.DelState(IssuancePolicyPrefix + policy.Class)
+	} else {
+		err = stub.PutState(IssuancePolicyPrefix+policy.Class, policyJson)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{Action: "SetIssuancePolicy", Ref: policy.Class, Data: policyJson})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: class
+func (t *OceanChaincode) queryIssuancePolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	policyBytes, err := stub.GetState(IssuancePolicyPrefix + args[0])
+	if len(policyBytes) == 0 || err != nil {
+		res.Msg = "issuance policy not exist"
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = policyBytes
+	return t.response(res)
+}
+
+// args: requestID
+func (t *OceanChaincode) queryIssuanceRequest(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	request, err := t.getIssuanceRequest(stub, args[0])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	// report a lapsed request as expired even before expireIssuance ran
+	if request.Status == IssuancePending && now/int64(time.Second) >= request.ExpiresAt {
+		request.Status = IssuanceExpired
+	}
+
+	requestData, err := json.Marshal(request)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = requestData
+	return t.response(res)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A holder may cap what its address spends of a token per period. Spending is
+// the sum of the "-" wallet entries inside the period, so no counter has to be
+// maintained. A debit taking the total above Limit needs the co-signer
+// registered with the limit to sign the same payload, which carries the action
+// and nonce of the debit so the co-signature can not be used again. Every
+// limited debit and limit change advances a spending clock of the address to
+// the ledger time and is rejected if it is older; periods and the raise delay
+// are measured on that clock.
+
+const (
+	PeriodDaily   = "daily"
+	PeriodRolling = "rolling"
+
+	// LimitRaiseDelay is how long a loosened limit waits before it applies.
+	LimitRaiseDelay = 24 * 60 * 60
+)
+
+type SpendingLimit struct {
+	Address  string `json:"address"`
+	TokenID  string `json:"tokenID"`
+	Limit    string `json:"limit"`
+	Period   string `json:"period"`
+	Window   int64  `json:"window"`
+	CoSigner string `json:"coSigner"`
+
+	// Pending holds a loosened limit until EffectiveAt.
+	Pending     *SpendingLimit `json:"pending,omitempty"`
+	EffectiveAt int64          `json:"effectiveAt,omitempty"`
+}
+
+type SpendingInfo struct {
+	Limit *SpendingLimit `json:"limit"`
+	Spent string         `json:"spent"`
+}
+
+func (t *OceanChaincode) getSpendingLimitState(stub shim.ChaincodeStubInterface, address, tokenID string) (string, *SpendingLimit, error) {
+	compositeKey, err := stub.CreateCompositeKey(SpendingLimitPrefix, []string{address, tokenID})
+	if err != nil {
+		return "", nil, err
+	}
+
+	limitBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(limitBytes) == 0 {
+		return compositeKey, nil, nil
+	}
+
+	limit := &SpendingLimit{}
+	err = json.Unmarshal(limitBytes, limit)
+	if err != nil {
+		return "", nil, errors.New("json unmarshal fail")
+	}
+
+	return compositeKey, limit, nil
+}
+
+// getSpendingClock returns the spending clock of address in seconds.
+func getSpendingClock(stub shim.ChaincodeStubInterface, address string) (int64, error) {
+	clockBytes, err := stub.GetState(SpendingClockPrefix + address)
+	if err != nil || len(clockBytes) == 0 {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(clockBytes), 10, 64)
+}
+
+// advanceSpendingClock moves the spending clock of address to the ledger
+// time and returns it, failing if the transaction is older.
+func advanceSpendingClock(stub shim.ChaincodeStubInterface, address string) (int64, error) {
+	clock, err := getSpendingClock(stub, address)
+	if err != nil {
+		return 0, err
+	}
+
+	now, err := getLedgerTime(stub)
+	if err != nil {
+		return 0, err
+	}
+
+	if now < clock {
+		return 0, errors.New("transaction time before spending clock " + strconv.FormatInt(clock, 10) + " of " + address)
+	}
+
+	return now, stub.PutState(SpendingClockPrefix+address, []byte(strconv.FormatInt(now, 10)))
+}
+
+// getSpendingLimit returns the limit in force at now, seconds, taking a
+// pending change into account once it is effective.
+func (t *OceanChaincode) getSpendingLimit(stub shim.ChaincodeStubInterface, address, tokenID string, now int64) (*SpendingLimit, error) {
+	_, limit, err := t.getSpendingLimitState(stub, address, tokenID)
+	if err != nil || limit == nil {
+		return nil, err
+	}
+
+	if limit.Pending != nil && now >= limit.EffectiveAt {
+		return limit.Pending, nil
+	}
+
+	return limit, nil
+}
+
+// periodStart returns, in seconds, when the period of limit containing now began.
+func periodStart(limit *SpendingLimit, now int64) int64 {
+	if limit.Period == PeriodDaily {
+		return now - now%(24*60*60)
+	}
+
+	return now - limit.Window
+}
+
+// getSpentSince sums the debits of tokenID by address with a timestamp at or
+// after since, in seconds.
+func (t *OceanChaincode) getSpentSince(stub shim.ChaincodeStubInterface, address, tokenID string, since int64) (*big.Int, error) {
+	iterator, err := t.getWalletIterator(stub, address, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	spent := big.NewInt(0)
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		entry, err := getWalletEntry(responseRange.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Timestamp < since*int64(time.Second) {
+			continue
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		if compositeKeyParts[1] != "-" {
+			continue
+		}
+
+		num := compositeKeyParts[2]
+		numBigInt, success := new(big.Int).SetString(num, 10)
+		if !success {
+			return nil, errors.New("number not match: " + num)
+		}
+
+		spent.Add(spent, numBigInt)
+	}
+
+	return spent, nil
+}
+
+// checkSpendingLimit fails if debiting number of tokenID from address takes
+// it above its spending limit, unless coSign holds the co-signer's public key
+// and signature over payloadHex, a payload verifyPayload spent the nonce of.
+func (t *OceanChaincode) checkSpendingLimit(stub shim.ChaincodeStubInterface, address, tokenID, number, payloadHex string, coSign []string) error {
+	_, state, err := t.getSpendingLimitState(stub, address, tokenID)
+	if err != nil || state == nil {
+		return err
+	}
+
+	now, err := advanceSpendingClock(stub, address)
+	if err != nil {
+		return err
+	}
+
+	limit, err := t.getSpendingLimit(stub, address, tokenID, now)
+	if err != nil || limit == nil {
+		return err
+	}
+
+	spent, err := t.getSpentSince(stub, address, tokenID, periodStart(limit, now))
+	if err != nil {
+		return err
+	}
+
+	numBigInt, success := new(big.Int).SetString(number, 10)
+	if !success {
+		return errors.New("number not match: " + number)
+	}
+
+	maximum, _ := new(big.Int).SetString(limit.Limit, 10)
+	if spent.Add(spent, numBigInt).Cmp(maximum) <= 0 {
+		return nil
+	}
+
+	if limit.CoSigner == "" {
+		return errors.New("spending limit " + limit.Limit + " of " + tokenID + " exceeded")
+	}
+
+	if len(coSign) != 2 {
+		return errors.New("spending limit " + limit.Limit + " of " + tokenID + " exceeded, co-signature required")
+	}
+
+	if GetAddress(coSign[0]) != limit.CoSigner {
+		return errors.New("co-signer public key not match")
+	}
+
+	verify, err := Verify(coSign[0], payloadHex, coSign[1])
+	if err != nil || !verify {
+		return errors.New("co-signature verify fail")
+	}
+
+	// a payload without action and nonce could be submitted again with it
+	payloadJson, err := hex.DecodeString(payloadHex)
+	if err != nil {
+		return err
+	}
+
+	signed := SignedPayload{}
+	err = json.Unmarshal(payloadJson, &signed)
+	if err != nil || signed.Action == "" || signed.Nonce == "" {
+		return errors.New("co-signed payload need an action and nonce")
+	}
+
+	return nil
+}
+
+// isTighter reports whether next only restricts current, so it can apply at once.
+func isTighter(current, next *SpendingLimit) bool {
+	currentLimit, _ := new(big.Int).SetString(current.Limit, 10)
+	nextLimit, _ := new(big.Int).SetString(next.Limit, 10)
+
+	if nextLimit.Cmp(currentLimit) > 0 || next.Period != current.Period {
+		return false
+	}
+
+	if next.Period == PeriodRolling && next.Window < current.Window {
+		return false
+	}
+
+	return current.CoSigner == "" || next.CoSigner == current.CoSigner
+}
+
+// args: pubKey, payload hex of SpendingLimit{tokenID, limit, period, window, coSigner}, sign
+func (t *OceanChaincode) setSpendingLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	next := SpendingLimit{}
+	address, err := verifyPayload(stub, "setSpendingLimit", args[0], args[1], args[2], &next)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = t.getToken(stub, next.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if next.Limit != "0" && !IsGtZeroInteger(next.Limit) {
+		return shim.Error("limit need to be a non-negative integer")
+	}
+
+	if next.Period != PeriodDaily && next.Period != PeriodRolling {
+		return shim.Error("period need to be " + PeriodDaily + " or " + PeriodRolling)
+	}
+
+	if next.Period == PeriodRolling && next.Window <= 0 {
+		return shim.Error("window need to be greater than 0")
+	}
+
+	if next.CoSigner != "" && (!IsValidAddress(next.CoSigner) || next.CoSigner == address) {
+		return shim.Error("coSigner is invalid")
+	}
+
+	now, err := advanceSpendingClock(stub, address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	compositeKey, limit, err := t.getSpendingLimitState(stub, address, next.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	next.Address = address
+	next.Pending = nil
+	next.EffectiveAt = 0
+
+	// a tighter limit applies at once and drops any pending change
+	if limit != nil {
+		current := *limit
+		if limit.Pending != nil && now >= limit.EffectiveAt {
+			current = *limit.Pending
+		}
+		current.Pending = nil
+		current.EffectiveAt = 0
+
+		if !isTighter(&current, &next) {
+			pending := next
+			current.Pending = &pending
+			current.EffectiveAt = now + LimitRaiseDelay
+			next = current
+		}
+	}
+
+	limitJson, err := json.Marshal(&next)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, limitJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "SetSpendingLimit",
+		TokenID: next.TokenID,
+		From:    address,
+		Data:    limitJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: address, tokenID
+func (t *OceanChaincode) querySpendingLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	_, limit, err := t.getSpendingLimitState(stub, args[0], args[1])
+	if err != nil || limit == nil {
+		res.Msg = "spending limit not exist"
+		return t.response(res)
+	}
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+	now = now / int64(time.Second)
+
+	clock, err := getSpendingClock(stub, args[0])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	if now < clock {
+		now = clock
+	}
+
+	current, err := t.getSpendingLimit(stub, args[0], args[1], now)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	spent, err := t.getSpentSince(stub, args[0], args[1], periodStart(current, now))
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	infoData, err := json.Marshal(&SpendingInfo{Limit: limit, Spent: spent.String()})
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = infoData
+	return t.response(res)
+}
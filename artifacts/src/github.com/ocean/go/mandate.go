@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A mandate, signed by the payer, lets the merchant collect up to
+// MaxPerPeriod of a token once in every Period seconds from Start until End.
+// Periods are collected in order: a collection always takes period Periods,
+// the one after the last collected, once it has started by ledger time, so
+// no timestamp lets a merchant collect ahead. Each collection is recorded under
+// MandateCollectPrefix by period index, so a period can never be collected
+// twice. The payer cancels with a MandateCancel signed for cancelMandate.
+
+const (
+	MandateActive    = "active"
+	MandateCancelled = "cancelled"
+)
+
+type Mandate struct {
+	MandateID    string `json:"mandateID"`
+	Payer        string `json:"payer"`
+	Merchant     string `json:"merchant"`
+	TokenID      string `json:"tokenID"`
+	MaxPerPeriod string `json:"maxPerPeriod"`
+	Period       int64  `json:"period"`
+	Start        int64  `json:"start"`
+	End          int64  `json:"end"`
+	Status       string `json:"status"`
+	Collected    string `json:"collected"`
+	Periods      int64  `json:"periods"`
+}
+
+type MandateCancel struct {
+	MandateID string `json:"mandateID"`
+}
+
+type MandateCollection struct {
+	MandateID string `json:"mandateID"`
+	Number    string `json:"number"`
+	Memo      string `json:"memo,omitempty"`
+}
+
+func (t *OceanChaincode) getMandate(stub shim.ChaincodeStubInterface, mandateID string) (*Mandate, error) {
+	mandateBytes, err := stub.GetState(MandatePrefix + mandateID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mandateBytes) == 0 {
+		return nil, errors.New("mandate not exist")
+	}
+
+	mandate := &Mandate{}
+	err = json.Unmarshal(mandateBytes, mandate)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return mandate, nil
+}
+
+func (t *OceanChaincode) putMandate(stub shim.ChaincodeStubInterface, mandate *Mandate) ([]byte, error) {
+	mandateJson, err := json.Marshal(mandate)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return mandateJson, stub.PutState(MandatePrefix+mandate.MandateID, mandateJson)
+}
+
+// args: payer pubKey, payload hex of Mandate{mandateID, merchant, tokenID, maxPerPeriod, period, start, end}, sign
+func (t *OceanChaincode) createMandate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	mandate := Mandate{}
+	address, err := verifyPayload(stub, "createMandate", args[0], args[1], args[2], &mandate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if mandate.MandateID == "" {
+		return shim.Error("mandateID is null")
+	}
+
+	if !IsValidAddress(mandate.Merchant) || mandate.Merchant == address {
+		return shim.Error("merchant is invalid")
+	}
+
+	if !IsGtZeroInteger(mandate.MaxPerPeriod) {
+		return shim.Error("maxPerPeriod need to be greater than 0 integer")
+	}
+
+	if mandate.Period <= 0 {
+		return shim.Error("period need to be greater than 0")
+	}
+
+	token, err := t.getToken(stub, mandate.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if token.Collection != "" {
+		return shim.Error("private token can not be collected by mandate")
+	}
+
+	err = t.checkNotRetired(stub, address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	mandateBytes, err := stub.GetState(MandatePrefix + mandate.MandateID)
+	if len(mandateBytes) != 0 {
+		return shim.Error("mandate already existed")
+	}
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if mandate.Start == 0 {
+		mandate.Start = now / int64(time.Second)
+	}
+
+	if mandate.End <= mandate.Start || mandate.End <= now/int64(time.Second) {
+		return shim.Error("end need to be after start and now")
+	}
+
+	mandate.Payer = address
+	mandate.Status = MandateActive
+	mandate.Collected = "0"
+	mandate.Periods = 0
+
+	mandateJson, err := t.putMandate(stub, &mandate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "CreateMandate",
+		Ref:     mandate.MandateID,
+		TokenID: mandate.TokenID,
+		From:    mandate.Payer,
+		To:      mandate.Merchant,
+		Number:  mandate.MaxPerPeriod,
+		Data:    mandateJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: merchant pubKey, payload hex of MandateCollection{mandateID, number, memo}, sign
+func (t *OceanChaincode) collect(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	collection := MandateCollection{}
+	address, err := verifyPayload(stub, "collect", args[0], args[1], args[2], &collection)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	mandate, err := t.getMandate(stub, collection.MandateID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != mandate.Merchant {
+		return shim.Error("only merchant can collect")
+	}
+
+	if mandate.Status != MandateActive {
+		return shim.Error("mandate is " + mandate.Status)
+	}
+
+	if !IsGtZeroInteger(collection.Number) {
+		return shim.Error("number need to be greater than 0 integer")
+	}
+
+	number, _ := new(big.Int).SetString(collection.Number, 10)
+	maximum, _ := new(big.Int).SetString(mandate.MaxPerPeriod, 10)
+	if number.Cmp(maximum) > 0 {
+		return shim.Error("number greater than maxPerPeriod " + mandate.MaxPerPeriod)
+	}
+
+	now, err := getLedgerTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now >= mandate.End {
+		return shim.Error("mandate ended")
+	}
+
+	// only the period after the last collected one, once it started
+	start := mandate.Start + mandate.Periods*mandate.Period
+	if start >= mandate.End {
+		return shim.Error("all periods of mandate collected")
+	}
+
+	if now < start {
+		return shim.Error("period " + strconv.FormatInt(mandate.Periods, 10) + " starts at " + strconv.FormatInt(start, 10))
+	}
+
+	period := strconv.FormatInt(mandate.Periods, 10)
+
+	compositeKey, err := stub.CreateCompositeKey(MandateCollectPrefix, []string{mandate.MandateID, period})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	collectedBytes, err := stub.GetState(compositeKey)
+	if len(collectedBytes) != 0 {
+		return shim.Error("period " + period + " already collected")
+	}
+
+	token, err := t.getToken(stub, mandate.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.checkNotRetired(stub, mandate.Merchant)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ref := "mandate:" + mandate.MandateID + ":" + period
+
+	err = t.debitWallet(stub, token, mandate.Payer, mandate.TokenID, collection.Number, ref, "", nil)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putWalletEntry(stub, token.Collection, mandate.Merchant, mandate.TokenID, "+", collection.Number, ref)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	collectionJson, err := json.Marshal(&collection)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, collectionJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	collected, _ := new(big.Int).SetString(mandate.Collected, 10)
+	mandate.Collected = collected.Add(collected, number).String()
+	mandate.Periods++
+
+	mandateJson, err := t.putMandate(stub, mandate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "Collect",
+		Ref:     mandate.MandateID,
+		TokenID: mandate.TokenID,
+		From:    mandate.Payer,
+		To:      mandate.Merchant,
+		Number:  collection.Number,
+		Memo:    collection.Memo,
+		Data:    mandateJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: payer pubKey, payload hex of MandateCancel{mandateID}, sign
+func (t *OceanChaincode) cancelMandate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	request := MandateCancel{}
+	address, err := verifyPayload(stub, "cancelMandate", args[0], args[1], args[2], &request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	mandate, err := t.getMandate(stub, request.MandateID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != mandate.Payer {
+		return shim.Error("only payer can cancel mandate")
+	}
+
+	if mandate.Status != MandateActive {
+		return shim.Error("mandate is " + mandate.Status)
+	}
+
+	mandate.Status = MandateCancelled
+
+	mandateJson, err := t.putMandate(stub, mandate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "CancelMandate",
+		Ref:     mandate.MandateID,
+		TokenID: mandate.TokenID,
+		From:    mandate.Payer,
+		To:      mandate.Merchant,
+		Data:    mandateJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: mandateID
+func (t *OceanChaincode) queryMandate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	mandateBytes, err := stub.GetState(MandatePrefix + args[0])
+	if len(mandateBytes) == 0 || err != nil {
+		res.Msg = "mandate not exist"
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = mandateBytes
+	return t.response(res)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"strings"
+)
+
+// Merkle trees over sha256. A leaf hashes 0x00 and its fields joined by 0x00,
+// an inner node hashes 0x01 and its two children, so a leaf can not pose as a
+// node. A node without a sibling moves up a level unchanged. In a sum tree
+// every leaf has an amount, an inner node hashes 0x02, its two children and
+// their sums, and the root hashes 0x03, the top node and the sum of the tree,
+// so a path also proves the sum of the whole tree. These
+// functions are meant for offline verifiers as much as for the chaincode.
+
+type MerkleStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+type MerkleSumStep struct {
+	Hash string `json:"hash"`
+	Sum  string `json:"sum"`
+	Left bool   `json:"left"`
+}
+
+// MerkleLeaf hashes the fields of a leaf, which must not contain a 0x00 byte.
+func MerkleLeaf(fields ...string) []byte {
+	sum := sha256.Sum256(append([]byte{0}, strings.Join(fields, "\x00")...))
+	return sum[:]
+}
+
+func merkleNode(left, right []byte) []byte {
+	data := append([]byte{1}, left...)
+	data = append(data, right...)
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// merkleLevels returns every level of the tree over leaves, leaves first.
+func merkleLevels(leaves [][]byte) [][][]byte {
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			}
+		}
+
+		levels = append(levels, next)
+		level = next
+	}
+
+	return levels
+}
+
+// MerkleRoot returns the root of the tree over leaves, nil if there are none.
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	levels := merkleLevels(leaves)
+	return levels[len(levels)-1][0]
+}
+
+// merkleAppend adds leaf to the frontier of a tree built a page at a time,
+// the root of the complete subtree of each height or nil, lowest first.
+func merkleAppend(frontier [][]byte, leaf []byte) [][]byte {
+	node := leaf
+	for height := 0; height < len(frontier); height++ {
+		if frontier[height] == nil {
+			frontier[height] = node
+			return frontier
+		}
+
+		node = merkleNode(frontier[height], node)
+		frontier[height] = nil
+	}
+
+	return append(frontier, node)
+}
+
+// merkleFrontierRoot returns the root of the tree with frontier, the same as
+// MerkleRoot over all the leaves appended.
+func merkleFrontierRoot(frontier [][]byte) []byte {
+	var root []byte
+	for _, node := range frontier {
+		if node == nil {
+			continue
+		}
+
+		if root == nil {
+			root = node
+		} else {
+			root = merkleNode(node, root)
+		}
+	}
+
+	return root
+}
+
+// MerklePath returns the siblings from leaf index up to the root.
+func MerklePath(leaves [][]byte, index int) []*MerkleStep {
+	var path []*MerkleStep
+	for _, level := range merkleLevels(leaves) {
+		if len(level) == 1 {
+			break
+		}
+
+		sibling := index ^ 1
+		if sibling < len(level) {
+			path = append(path, &MerkleStep{Hash: hex.EncodeToString(level[sibling]), Left: sibling < index})
+		}
+		index /= 2
+	}
+
+	return path
+}
+
+// VerifyMerklePath checks that path leads from leaf to the hex root.
+func VerifyMerklePath(leaf []byte, path []*MerkleStep, root string) bool {
+	rootBytes, err := hex.DecodeString(root)
+	if err != nil {
+		return false
+	}
+
+	hash := leaf
+	for _, step := range path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return false
+		}
+
+		if step.Left {
+			hash = merkleNode(sibling, hash)
+		} else {
+			hash = merkleNode(hash, sibling)
+		}
+	}
+
+	return bytes.Equal(hash, rootBytes)
+}
+
+func merkleSumNode(left []byte, leftSum *big.Int, right []byte, rightSum *big.Int) []byte {
+	data := append([]byte{2}, left...)
+	data = append(data, right...)
+	data = append(data, leftSum.String()+"\x00"+rightSum.String()...)
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func merkleSumRoot(top []byte, sum *big.Int) []byte {
+	data := append([]byte{3}, top...)
+	data = append(data, sum.String()...)
+	root := sha256.Sum256(data)
+	return root[:]
+}
+
+// merkleSumLevels returns every level of the sum tree over leaves and their
+// amounts, leaves first.
+func merkleSumLevels(leaves [][]byte, amounts []*big.Int) ([][][]byte, [][]*big.Int) {
+	levels := [][][]byte{leaves}
+	sums := [][]*big.Int{amounts}
+	for level, levelSums := leaves, amounts; len(level) > 1; {
+		var next [][]byte
+		var nextSums []*big.Int
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				nextSums = append(nextSums, levelSums[i])
+			} else {
+				next = append(next, merkleSumNode(level[i], levelSums[i], level[i+1], levelSums[i+1]))
+				nextSums = append(nextSums, new(big.Int).Add(levelSums[i], levelSums[i+1]))
+			}
+		}
+
+		levels = append(levels, next)
+		sums = append(sums, nextSums)
+		level, levelSums = next, nextSums
+	}
+
+	return levels, sums
+}
+
+// MerkleSumRoot returns the root of the sum tree over leaves and their
+// amounts and the sum of the amounts, nil if there are no leaves.
+func MerkleSumRoot(leaves [][]byte, amounts []*big.Int) ([]byte, *big.Int) {
+	if len(leaves) == 0 {
+		return nil, nil
+	}
+
+	levels, sums := merkleSumLevels(leaves, amounts)
+	sum := sums[len(sums)-1][0]
+	return merkleSumRoot(levels[len(levels)-1][0], sum), sum
+}
+
+// MerkleSumPath returns the siblings and their sums from leaf index up to the
+// root of the sum tree.
+func MerkleSumPath(leaves [][]byte, amounts []*big.Int, index int) []*MerkleSumStep {
+	levels, sums := merkleSumLevels(leaves, amounts)
+
+	var path []*MerkleSumStep
+	for i, level := range levels {
+		if len(level) == 1 {
+			break
+		}
+
+		sibling := index ^ 1
+		if sibling < len(level) {
+			path = append(path, &MerkleSumStep{
+				Hash: hex.EncodeToString(level[sibling]),
+				Sum:  sums[i][sibling].String(),
+				Left: sibling < index,
+			})
+		}
+		index /= 2
+	}
+
+	return path
+}
+
+// VerifyMerkleSumPath checks that path leads from leaf with amount to the hex
+// root and returns the sum of the tree. Sums on the path must not be
+// negative, so the positive leaves that verify never add up to more than the
+// sum of the tree.
+func VerifyMerkleSumPath(leaf []byte, amount *big.Int, path []*MerkleSumStep, root string) (*big.Int, bool) {
+	rootBytes, err := hex.DecodeString(root)
+	if err != nil || amount.Sign() < 0 {
+		return nil, false
+	}
+
+	hash, sum := leaf, new(big.Int).Set(amount)
+	for _, step := range path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return nil, false
+		}
+
+		siblingSum, success := new(big.Int).SetString(step.Sum, 10)
+		if !success || siblingSum.Sign() < 0 {
+			return nil, false
+		}
+
+		if step.Left {
+			hash = merkleSumNode(sibling, siblingSum, hash, sum)
+		} else {
+			hash = merkleSumNode(hash, sum, sibling, siblingSum)
+		}
+		sum.Add(sum, siblingSum)
+	}
+
+	if !bytes.Equal(merkleSumRoot(hash, sum), rootBytes) {
+		return nil, false
+	}
+
+	return sum, true
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/hex"
+	"math/big"
+	"strconv"
+	"testing"
+)
+
+func balanceProof(tokenID string, addresses, balances []string, index int) (string, *BalanceInclusionProof) {
+	leaves := make([][]byte, len(addresses))
+	for i := range addresses {
+		leaves[i] = MerkleLeaf(tokenID, addresses[i], balances[i])
+	}
+
+	root := hex.EncodeToString(MerkleRoot(leaves))
+	return root, &BalanceInclusionProof{
+		TokenID: tokenID,
+		Address: addresses[index],
+		Balance: balances[index],
+		Leaf:    hex.EncodeToString(leaves[index]),
+		Path:    MerklePath(leaves, index),
+		Root:    root,
+	}
+}
+
+func holders(n int) ([]string, []string) {
+	addresses := make([]string, n)
+	balances := make([]string, n)
+	for i := 0; i < n; i++ {
+		addresses[i] = "address" + strconv.Itoa(i)
+		balances[i] = strconv.Itoa(100 * (i + 1))
+	}
+
+	return addresses, balances
+}
+
+func TestVerifyBalanceInclusion(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		addresses, balances := holders(n)
+		for _, index := range []int{0, n / 2, n - 1} {
+			root, proof := balanceProof("token", addresses, balances, index)
+			if !VerifyBalanceInclusion(root, proof) {
+				t.Errorf("proof of leaf %d of %d failed", index, n)
+			}
+		}
+	}
+}
+
+func TestVerifyBalanceInclusionOnlyLeaf(t *testing.T) {
+	root, proof := balanceProof("token", []string{"address"}, []string{"100"}, 0)
+	if len(proof.Path) != 0 || root != proof.Leaf {
+		t.Fatal("root of a single leaf must be the leaf")
+	}
+
+	if !VerifyBalanceInclusion(root, proof) {
+		t.Error("proof of the only leaf failed")
+	}
+}
+
+func TestVerifyBalanceInclusionWrongBalance(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		addresses, balances := holders(n)
+		for _, index := range []int{0, n - 1} {
+			root, proof := balanceProof("token", addresses, balances, index)
+
+			proof.Balance = "1"
+			if VerifyBalanceInclusion(root, proof) {
+				t.Errorf("proof of leaf %d of %d verified a wrong balance", index, n)
+			}
+
+			// a leaf recomputed for the wrong balance must not verify either
+			proof.Leaf = hex.EncodeToString(MerkleLeaf(proof.TokenID, proof.Address, proof.Balance))
+			if VerifyBalanceInclusion(root, proof) {
+				t.Errorf("proof of leaf %d of %d verified a forged leaf", index, n)
+			}
+		}
+	}
+}
+
+func TestVerifyMerklePathWrongRoot(t *testing.T) {
+	addresses, balances := holders(4)
+	_, proof := balanceProof("token", addresses, balances, 1)
+	otherRoot, _ := balanceProof("other", addresses, balances, 1)
+
+	if VerifyBalanceInclusion(otherRoot, proof) {
+		t.Error("proof verified against the root of another token")
+	}
+}
+
+func TestMerkleFrontierRoot(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		addresses, balances := holders(n)
+		leaves := balanceLeafHashes("token", addresses, balances)
+
+		var frontier [][]byte
+		for _, leaf := range leaves {
+			frontier = merkleAppend(frontier, leaf)
+		}
+
+		if hex.EncodeToString(merkleFrontierRoot(frontier)) != hex.EncodeToString(MerkleRoot(leaves)) {
+			t.Errorf("frontier root of %d leaves differs from the tree root", n)
+		}
+	}
+}
+
+func airdropTree(n int) ([][]byte, []*big.Int) {
+	addresses, balances := holders(n)
+	leaves := make([][]byte, n)
+	amounts := make([]*big.Int, n)
+	for i := range addresses {
+		leaves[i] = MerkleLeaf("airdrop", addresses[i], balances[i])
+		amounts[i], _ = new(big.Int).SetString(balances[i], 10)
+	}
+
+	return leaves, amounts
+}
+
+func TestVerifyMerkleSumPath(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves, amounts := airdropTree(n)
+		rootBytes, total := MerkleSumRoot(leaves, amounts)
+		root := hex.EncodeToString(rootBytes)
+
+		for _, index := range []int{0, n / 2, n - 1} {
+			path := MerkleSumPath(leaves, amounts, index)
+			sum, verify := VerifyMerkleSumPath(leaves[index], amounts[index], path, root)
+			if !verify {
+				t.Errorf("sum proof of leaf %d of %d failed", index, n)
+			} else if sum.Cmp(total) != 0 {
+				t.Errorf("sum proof of leaf %d of %d sums to %s not %s", index, n, sum, total)
+			}
+		}
+	}
+}
+
+func TestVerifyMerkleSumPathOnlyLeaf(t *testing.T) {
+	leaves, amounts := airdropTree(1)
+	rootBytes, total := MerkleSumRoot(leaves, amounts)
+
+	path := MerkleSumPath(leaves, amounts, 0)
+	sum, verify := VerifyMerkleSumPath(leaves[0], amounts[0], path, hex.EncodeToString(rootBytes))
+	if len(path) != 0 || !verify || sum.Cmp(total) != 0 {
+		t.Error("sum proof of the only leaf failed")
+	}
+}
+
+func TestVerifyMerkleSumPathWrongAmount(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves, amounts := airdropTree(n)
+		rootBytes, _ := MerkleSumRoot(leaves, amounts)
+		root := hex.EncodeToString(rootBytes)
+
+		for _, index := range []int{0, n - 1} {
+			path := MerkleSumPath(leaves, amounts, index)
+
+			// the amount is in the sums of the path as well as in the leaf
+			wrong := new(big.Int).Add(amounts[index], big.NewInt(1))
+			if _, verify := VerifyMerkleSumPath(leaves[index], wrong, path, root); verify {
+				t.Errorf("sum proof of leaf %d of %d verified a wrong amount", index, n)
+			}
+
+			leaf := MerkleLeaf("airdrop", "address"+strconv.Itoa(index), wrong.String())
+			if _, verify := VerifyMerkleSumPath(leaf, wrong, path, root); verify {
+				t.Errorf("sum proof of leaf %d of %d verified a forged leaf", index, n)
+			}
+		}
+	}
+}
+
+func TestVerifyMerkleSumPathNegativeSum(t *testing.T) {
+	// a negative leaf would let the others add up to more than the root sum
+	leaves, amounts := airdropTree(3)
+	amounts[1] = big.NewInt(-200)
+	rootBytes, total := MerkleSumRoot(leaves, amounts)
+	root := hex.EncodeToString(rootBytes)
+
+	claimable := big.NewInt(0)
+	for index := range leaves {
+		if amounts[index].Sign() <= 0 {
+			continue
+		}
+
+		path := MerkleSumPath(leaves, amounts, index)
+		if _, verify := VerifyMerkleSumPath(leaves[index], amounts[index], path, root); verify {
+			claimable.Add(claimable, amounts[index])
+		}
+	}
+
+	if claimable.Cmp(total) > 0 {
+		t.Errorf("leaves claiming %s verified against a tree summing to %s", claimable, total)
+	}
+}
@@ -20,8 +20,11 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"math"
 	"math/big"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -33,15 +36,84 @@ type OceanChaincode struct {
 }
 
 type Token struct {
-	Address     string `json:"address"`
-	TokenName   string `json:"tokenName"`
-	TotalNumber string `json:"totalNumber"`
+	Address     string       `json:"address"`
+	TokenName   string       `json:"tokenName"`
+	TotalNumber string       `json:"totalNumber"`
+	Collection  string       `json:"collection,omitempty"`
+	Origin      *TokenOrigin `json:"origin,omitempty"`
+
+	Permissioned bool   `json:"permissioned,omitempty"`
+	Compliance   string `json:"compliance,omitempty"`
+	Confidential bool   `json:"confidential,omitempty"`
+	Class        string `json:"class,omitempty"`
 }
 
 const (
 	TokenPrefix    = "TokenPrefix"
 	WalletPrefix   = "WalletPrefix"
 	TransferPrefix = "TransferPrefix"
+	NoncePrefix    = "NoncePrefix"
+	SnapshotPrefix = "SnapshotPrefix"
+	SnapshotSeqKey = "SnapshotSeq"
+	ProposalPrefix = "ProposalPrefix"
+	VotePrefix     = "VotePrefix"
+
+	TrustedCallerPrefix = "TrustedCallerPrefix"
+	CallerAuthPrefix    = "CallerAuthPrefix"
+	HoldPrefix          = "HoldPrefix"
+
+	BridgeReceiptPrefix = "BridgeReceiptPrefix"
+	BridgeSupplyPrefix  = "BridgeSupplyPrefix"
+
+	RecoveryPolicyPrefix = "RecoveryPolicyPrefix"
+	RecoveryPrefix       = "RecoveryPrefix"
+	RetiredPrefix        = "RetiredPrefix"
+	LedgerClockKey       = "LedgerClock"
+
+	SpendingLimitPrefix = "SpendingLimitPrefix"
+	SpendingClockPrefix = "SpendingClockPrefix"
+	ChequePrefix        = "ChequePrefix"
+
+	PaymentChannelPrefix = "PaymentChannelPrefix"
+	MandatePrefix        = "MandatePrefix"
+	MandateCollectPrefix = "MandateCollectPrefix"
+
+	OrderPrefix     = "OrderPrefix"
+	OrderBookPrefix = "OrderBookPrefix"
+	OrderSeqPrefix  = "OrderSeqPrefix"
+	PoolPrefix      = "PoolPrefix"
+	PoolPairPrefix  = "PoolPairPrefix"
+
+	AllowlistPrefix     = "AllowlistPrefix"
+	ComplianceSeqPrefix = "ComplianceSeqPrefix"
+	AttestorPrefix      = "AttestorPrefix"
+	ClaimPrefix         = "ClaimPrefix"
+	ClaimRulePrefix     = "ClaimRulePrefix"
+
+	RolePrefix = "RolePrefix"
+
+	IdemixConfigKey = "IdemixConfig"
+
+	ConfidentialPrefix = "ConfidentialPrefix"
+
+	IssuancePolicyPrefix  = "IssuancePolicyPrefix"
+	IssuanceRequestPrefix = "IssuanceRequestPrefix"
+	QuotaPrefix           = "QuotaPrefix"
+	QuotaUsagePrefix      = "QuotaUsagePrefix"
+
+	HolderPrefix          = "HolderPrefix"
+	AttestationPrefix     = "AttestationPrefix"
+	AttestationLeafPrefix = "AttestationLeafPrefix"
+
+	AirdropPrefix      = "AirdropPrefix"
+	AirdropClaimPrefix = "AirdropClaimPrefix"
+
+	AuditPrefix = "AuditPrefix"
+
+	RichQueryKey      = "RichQuery"
+	TokenDocPrefix    = "TokenDocPrefix"
+	TransferDocPrefix = "TransferDocPrefix"
+	WalletDocPrefix   = "WalletDocPrefix"
 )
 
 func (t *OceanChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
@@ -78,6 +150,12 @@ func (t *OceanChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Error(err.Error())
 	}
 
+	err = t.bootstrapAdmin(stub)
+	if err != nil {
+		logger.Error(err)
+		return shim.Error(err.Error())
+	}
+
 	return shim.Success(nil)
 }
 
@@ -86,6 +164,12 @@ func (t *OceanChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 
 	logger.Info("function =", function)
 
+	err := t.checkRoles(stub, function)
+	if err != nil {
+		logger.Error(err)
+		return shim.Error(err.Error())
+	}
+
 	if function == "delete" {
 		return t.delete(stub, args)
 	} else if function == "query" {
@@ -104,6 +188,196 @@ func (t *OceanChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.transfer(stub, args)
 	} else if function == "queryTx" {
 		return t.queryTx(stub, args)
+	} else if function == "createSnapshot" {
+		return t.createSnapshot(stub, args)
+	} else if function == "querySnapshot" {
+		return t.querySnapshot(stub, args)
+	} else if function == "balanceAt" {
+		return t.balanceAt(stub, args)
+	} else if function == "createProposal" {
+		return t.createProposal(stub, args)
+	} else if function == "castVote" {
+		return t.castVote(stub, args)
+	} else if function == "tallyProposal" {
+		return t.tallyProposal(stub, args)
+	} else if function == "queryProposal" {
+		return t.queryProposal(stub, args)
+	} else if function == "transferPrivate" {
+		return t.transferPrivate(stub, args)
+	} else if function == "queryPrivateBalance" {
+		return t.queryPrivateBalance(stub, args)
+	} else if function == "queryPrivateTx" {
+		return t.queryPrivateTx(stub, args)
+	} else if function == "registerCaller" {
+		return t.registerCaller(stub, args)
+	} else if function == "authorizeCaller" {
+		return t.authorizeCaller(stub, args)
+	} else if function == "balanceOf" {
+		return t.balanceOf(stub, args)
+	} else if function == "hold" {
+		return t.hold(stub, args)
+	} else if function == "settle" {
+		return t.settle(stub, args)
+	} else if function == "release" {
+		return t.release(stub, args)
+	} else if function == "queryHold" {
+		return t.queryHold(stub, args)
+	} else if function == "configureBridge" {
+		return t.configureBridge(stub, args)
+	} else if function == "lockToken" {
+		return t.lockToken(stub, args)
+	} else if function == "mintWrapped" {
+		return t.mintWrapped(stub, args)
+	} else if function == "burnWrapped" {
+		return t.burnWrapped(stub, args)
+	} else if function == "unlockToken" {
+		return t.unlockToken(stub, args)
+	} else if function == "queryBridgeSupply" {
+		return t.queryBridgeSupply(stub, args)
+	} else if function == "setRecoveryPolicy" {
+		return t.setRecoveryPolicy(stub, args)
+	} else if function == "requestRecovery" {
+		return t.requestRecovery(stub, args)
+	} else if function == "approveRecovery" {
+		return t.approveRecovery(stub, args)
+	} else if function == "cancelRecovery" {
+		return t.cancelRecovery(stub, args)
+	} else if function == "executeRecovery" {
+		return t.executeRecovery(stub, args)
+	} else if function == "queryRecovery" {
+		return t.queryRecovery(stub, args)
+	} else if function == "tick" {
+		return t.tick(stub, args)
+	} else if function == "queryClock" {
+		return t.queryClock(stub, args)
+	} else if function == "setSpendingLimit" {
+		return t.setSpendingLimit(stub, args)
+	} else if function == "querySpendingLimit" {
+		return t.querySpendingLimit(stub, args)
+	} else if function == "cashCheque" {
+		return t.cashCheque(stub, args)
+	} else if function == "voidCheque" {
+		return t.voidCheque(stub, args)
+	} else if function == "queryCheque" {
+		return t.queryCheque(stub, args)
+	} else if function == "openChannel" {
+		return t.openChannel(stub, args)
+	} else if function == "closeChannel" {
+		return t.closeChannel(stub, args)
+	} else if function == "settleChannel" {
+		return t.settleChannel(stub, args)
+	} else if function == "queryChannel" {
+		return t.queryChannel(stub, args)
+	} else if function == "createMandate" {
+		return t.createMandate(stub, args)
+	} else if function == "collect" {
+		return t.collect(stub, args)
+	} else if function == "cancelMandate" {
+		return t.cancelMandate(stub, args)
+	} else if function == "queryMandate" {
+		return t.queryMandate(stub, args)
+	} else if function == "placeOrder" {
+		return t.placeOrder(stub, args)
+	} else if function == "cancelOrder" {
+		return t.cancelOrder(stub, args)
+	} else if function == "queryOrderBook" {
+		return t.queryOrderBook(stub, args)
+	} else if function == "queryOrder" {
+		return t.queryOrder(stub, args)
+	} else if function == "createPool" {
+		return t.createPool(stub, args)
+	} else if function == "addLiquidity" {
+		return t.addLiquidity(stub, args)
+	} else if function == "removeLiquidity" {
+		return t.removeLiquidity(stub, args)
+	} else if function == "swapExact" {
+		return t.swapExact(stub, args)
+	} else if function == "queryPool" {
+		return t.queryPool(stub, args)
+	} else if function == "setPermissioned" {
+		return t.setPermissioned(stub, args)
+	} else if function == "updateAllowlist" {
+		return t.updateAllowlist(stub, args)
+	} else if function == "queryAllowlist" {
+		return t.queryAllowlist(stub, args)
+	} else if function == "registerAttestor" {
+		return t.registerAttestor(stub, args)
+	} else if function == "issueClaim" {
+		return t.issueClaim(stub, args)
+	} else if function == "revokeClaim" {
+		return t.revokeClaim(stub, args)
+	} else if function == "setClaimRules" {
+		return t.setClaimRules(stub, args)
+	} else if function == "queryClaims" {
+		return t.queryClaims(stub, args)
+	} else if function == "grantRole" {
+		return t.grantRole(stub, args)
+	} else if function == "revokeRole" {
+		return t.revokeRole(stub, args)
+	} else if function == "queryRoles" {
+		return t.queryRoles(stub, args)
+	} else if function == "queryCreatorRoles" {
+		return t.queryCreatorRoles(stub, args)
+	} else if function == "transferX509" {
+		return t.transferX509(stub, args)
+	} else if function == "configureIdemix" {
+		return t.configureIdemix(stub, args)
+	} else if function == "transferAnonymous" {
+		return t.transferAnonymous(stub, args)
+	} else if function == "queryNymAddress" {
+		return t.queryNymAddress(stub, args)
+	} else if function == "transferConfidential" {
+		return t.transferConfidential(stub, args)
+	} else if function == "queryConfidentialBalance" {
+		return t.queryConfidentialBalance(stub, args)
+	} else if function == "mint" {
+		return t.mint(stub, args)
+	} else if function == "approveIssuance" {
+		return t.approveIssuance(stub, args)
+	} else if function == "expireIssuance" {
+		return t.expireIssuance(stub, args)
+	} else if function == "setIssuancePolicy" {
+		return t.setIssuancePolicy(stub, args)
+	} else if function == "queryIssuancePolicy" {
+		return t.queryIssuancePolicy(stub, args)
+	} else if function == "queryIssuanceRequest" {
+		return t.queryIssuanceRequest(stub, args)
+	} else if function == "setQuota" {
+		return t.setQuota(stub, args)
+	} else if function == "queryQuota" {
+		return t.queryQuota(stub, args)
+	} else if function == "queryQuotaHistory" {
+		return t.queryQuotaHistory(stub, args)
+	} else if function == "attestBalances" {
+		return t.attestBalances(stub, args)
+	} else if function == "proveBalance" {
+		return t.proveBalance(stub, args)
+	} else if function == "queryAttestation" {
+		return t.queryAttestation(stub, args)
+	} else if function == "fundAirdrop" {
+		return t.fundAirdrop(stub, args)
+	} else if function == "claimAirdrop" {
+		return t.claimAirdrop(stub, args)
+	} else if function == "reclaimAirdrop" {
+		return t.reclaimAirdrop(stub, args)
+	} else if function == "queryAirdrop" {
+		return t.queryAirdrop(stub, args)
+	} else if function == "auditToken" {
+		return t.auditToken(stub, args)
+	} else if function == "signAudit" {
+		return t.signAudit(stub, args)
+	} else if function == "queryAudit" {
+		return t.queryAudit(stub, args)
+	} else if function == "configureRichQuery" {
+		return t.configureRichQuery(stub, args)
+	} else if function == "queryTransfersByToken" {
+		return t.queryTransfersByToken(stub, args)
+	} else if function == "queryLargeTransfers" {
+		return t.queryLargeTransfers(stub, args)
+	} else if function == "queryWalletEntries" {
+		return t.queryWalletEntries(stub, args)
+	} else if function == "queryTokensByIssuer" {
+		return t.queryTokensByIssuer(stub, args)
 	}
 
 	logger.Error("func unknown : " + function)
@@ -111,34 +385,33 @@ func (t *OceanChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 }
 
 func (t *OceanChaincode) issueToken(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 4 {
+	if len(args) != 4 && len(args) != 5 {
 		return shim.Error("incorrect number of args")
 	}
 
 	tokenID := args[0]
 
-	verify, err := Verify(args[1], args[2], args[3])
-	if !verify {
-		return shim.Error("verify fail: " + err.Error())
+	token := Token{}
+	address, err := verifyPayload(stub, "issueToken", args[1], args[2], args[3], &token)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
 	if tokenID == "" {
 		return shim.Error("tokenID is null")
 	}
 
-	tokenJson, err := hex.DecodeString(args[2])
-	if err != nil {
-		return shim.Error(err.Error())
+	// "/" is reserved for wrapped and LP tokens the chaincode creates itself
+	if strings.Contains(tokenID, "/") {
+		return shim.Error("tokenID can not contain /")
 	}
 
-	token := Token{}
-	err = json.Unmarshal(tokenJson, &token)
-	if err != nil {
-		return shim.Error("json unmarshal fail")
+	if address != token.Address {
+		return shim.Error("address and public key not match")
 	}
 
-	if GetAddress(args[1]) != token.Address {
-		return shim.Error("address and public key not match")
+	if token.Origin != nil {
+		return shim.Error("wrapped token can only be minted by the bridge")
 	}
 
 	if len(token.TokenName) < 2 || len(token.TokenName) > 16 {
@@ -160,22 +433,49 @@ func (t *OceanChaincode) issueToken(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("token already existed")
 	}
 
-	err = stub.PutState(TokenPrefix+tokenID, tokenJson)
-	if err != nil {
-		return shim.Error(err.Error())
+	if token.Confidential {
+		if token.Collection != "" {
+			return shim.Error("token can not be both confidential and private")
+		}
+
+		err = checkConfidentialSupply(token.TotalNumber)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// args[4], if given, holds approvals of the issuance policy of the class
+	return t.requestIssuance(stub, IssuanceIssue, IssuanceIssue+":"+tokenID, tokenID, token.Class, args[2], args[4:])
+}
+
+// createToken stores token, credits its supply to the issuer and returns the
+// event of the issuance for the caller to emit.
+func (t *OceanChaincode) createToken(stub shim.ChaincodeStubInterface, tokenID string, token *Token, tokenJson []byte) (*Event, error) {
+	tokenIDBytes, err := stub.GetState(TokenPrefix + tokenID)
+	if len(tokenIDBytes) != 0 {
+		return nil, errors.New("token already existed")
 	}
 
-	compositeKey, err := stub.CreateCompositeKey(WalletPrefix+token.Address, []string{tokenID, "+", token.TotalNumber, "issueToken"})
+	err = t.putToken(stub, tokenID, tokenJson)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
-	err = stub.PutState(compositeKey, []byte{0})
+	if token.Confidential {
+		err = t.issueConfidential(stub, token, tokenID)
+	} else {
+		err = t.putTokenWalletEntry(stub, token, token.Collection, token.Address, tokenID, "+", token.TotalNumber, "issueToken")
+	}
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
-	return shim.Success(nil)
+	return &Event{
+		Action:  "IssueToken",
+		TokenID: tokenID,
+		To:      token.Address,
+		Number:  token.TotalNumber,
+	}, nil
 }
 
 type Response struct {
@@ -384,16 +684,310 @@ func (t *OceanChaincode) getBalance(stub shim.ChaincodeStubInterface, address st
 	return &balanceInfo, nil
 }
 
+// WalletEntry is the value stored under every wallet composite key. Entries
+// written before it existed hold a single zero byte and are treated as having
+// timestamp 0 and sequence 0.
+type WalletEntry struct {
+	TxID      string `json:"txID"`
+	Timestamp int64  `json:"timestamp"`
+	Sequence  int64  `json:"sequence,omitempty"`
+}
+
+// putWalletEntry records a "+" or "-" delta of number tokenID for address,
+// stamped with txID, the transaction timestamp and the snapshot sequence of
+// the token, which is what balances at a snapshot go by. Entries of tokens issued
+// into a private data collection are written to that collection. Both
+// parties of a permissioned token must be on its allowlist.
+func (t *OceanChaincode) putWalletEntry(stub shim.ChaincodeStubInterface, collection, address, tokenID, operation, number, txID string) error {
+	token, err := t.getToken(stub, tokenID)
+	if err != nil {
+		return err
+	}
+
+	return t.putTokenWalletEntry(stub, token, collection, address, tokenID, operation, number, txID)
+}
+
+// putTokenWalletEntry is putWalletEntry for a caller already holding token.
+// Callers that write token in the same transaction must use it, GetState does
+// not see the writes of the transaction it runs in.
+func (t *OceanChaincode) putTokenWalletEntry(stub shim.ChaincodeStubInterface, token *Token, collection, address, tokenID, operation, number, txID string) error {
+	party := "recipient"
+	if operation == "-" {
+		party = "sender"
+	}
+
+	err := t.checkAllowed(stub, token, tokenID, address, party)
+	if err != nil {
+		return err
+	}
+
+	return t.writeWalletEntry(stub, collection, address, tokenID, operation, number, txID)
+}
+
+// putRefundEntry credits address with escrowed tokens it was debited for. It
+// skips the allowlist and claim checks, which address passed when it was
+// debited, so an address taken off the allowlist can still get its escrow
+// back.
+func (t *OceanChaincode) putRefundEntry(stub shim.ChaincodeStubInterface, address, tokenID, number, txID string) error {
+	return t.writeWalletEntry(stub, "", address, tokenID, "+", number, txID)
+}
+
+// writeWalletEntry writes the entry without checking the parties.
+func (t *OceanChaincode) writeWalletEntry(stub shim.ChaincodeStubInterface, collection, address, tokenID, operation, number, txID string) error {
+	if operation == "+" {
+		err := t.indexHolder(stub, collection, tokenID, address)
+		if err != nil {
+			return err
+		}
+	}
+
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	sequence, err := getSnapshotSequence(stub, tokenID)
+	if err != nil {
+		return err
+	}
+
+	entryJson, err := json.Marshal(&WalletEntry{TxID: txID, Timestamp: timestamp, Sequence: sequence})
+	if err != nil {
+		return err
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(WalletPrefix+address, []string{tokenID, operation, number, txID})
+	if err != nil {
+		return err
+	}
+
+	if collection != "" {
+		return stub.PutPrivateData(collection, compositeKey, entryJson)
+	}
+
+	err = stub.PutState(compositeKey, entryJson)
+	if err != nil {
+		return err
+	}
+
+	return t.putWalletDoc(stub, address, tokenID, operation, number, txID, timestamp)
+}
+
+// debitWallet writes the "-" wallet entry for a debit authorized by address
+// over payloadHex, after checking the address is not retired, holds number of
+// tokenID and stays within its spending limit unless coSign approves it.
+func (t *OceanChaincode) debitWallet(stub shim.ChaincodeStubInterface, token *Token, address, tokenID, number, ref, payloadHex string, coSign []string) error {
+	if token.Confidential {
+		return errors.New("token is confidential, use transferConfidential")
+	}
+
+	err := t.checkNotRetired(stub, address)
+	if err != nil {
+		return err
+	}
+
+	balance, err := t.getTokenBalance(stub, address, tokenID)
+	if err != nil {
+		return err
+	}
+
+	numBigInt, success := new(big.Int).SetString(number, 10)
+	if !success {
+		return errors.New("number not match: " + number)
+	}
+
+	if balance.Cmp(numBigInt) < 0 {
+		return errors.New("balance of " + address + " " + balance.String() + " less than " + "number " + number)
+	}
+
+	err = t.checkSpendingLimit(stub, address, tokenID, number, payloadHex, coSign)
+	if err != nil {
+		return err
+	}
+
+	return t.putWalletEntry(stub, token.Collection, address, tokenID, "-", number, ref)
+}
+
+// getWalletIterator iterates the wallet entries of address for tokenID,
+// reading from the token's private data collection when it has one.
+func (t *OceanChaincode) getWalletIterator(stub shim.ChaincodeStubInterface, address, tokenID string) (shim.StateQueryIteratorInterface, error) {
+	token, err := t.getToken(stub, tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Collection != "" {
+		return stub.GetPrivateDataByPartialCompositeKey(token.Collection, WalletPrefix+address, []string{tokenID})
+	}
+
+	return stub.GetStateByPartialCompositeKey(WalletPrefix+address, []string{tokenID})
+}
+
+// getTokenBalance returns the current balance of tokenID for address.
+func (t *OceanChaincode) getTokenBalance(stub shim.ChaincodeStubInterface, address, tokenID string) (*big.Int, error) {
+	return t.getBalanceAt(stub, address, tokenID, math.MaxInt64)
+}
+
+// getWalletEntry decodes the value of a wallet composite key.
+func getWalletEntry(value []byte) (*WalletEntry, error) {
+	entry := &WalletEntry{}
+	if len(value) == 0 || (len(value) == 1 && value[0] == 0) {
+		return entry, nil
+	}
+
+	err := json.Unmarshal(value, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// getTxTimestamp returns the transaction timestamp in unix nanoseconds.
+func getTxTimestamp(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+
+	return ts.Seconds*int64(time.Second) + int64(ts.Nanos), nil
+}
+
+// putToken stores a token definition and its rich query document.
+func (t *OceanChaincode) putToken(stub shim.ChaincodeStubInterface, tokenID string, tokenJson []byte) error {
+	err := stub.PutState(TokenPrefix+tokenID, tokenJson)
+	if err != nil {
+		return err
+	}
+
+	return t.putTokenDoc(stub, tokenID, tokenJson)
+}
+
+// getToken loads a token definition from state.
+func (t *OceanChaincode) getToken(stub shim.ChaincodeStubInterface, tokenID string) (*Token, error) {
+	tokenBytes, err := stub.GetState(TokenPrefix + tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokenBytes) == 0 {
+		return nil, errors.New("token not exist")
+	}
+
+	token := &Token{}
+	err = json.Unmarshal(tokenBytes, token)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return token, nil
+}
+
+// SignedPayload is carried by every payload checked by verifyPayload: the
+// function it was signed for, so it can not be submitted to another one, and
+// a nonce its signer never uses twice, so it can not be submitted again.
+type SignedPayload struct {
+	Action string `json:"action"`
+	Nonce  string `json:"nonce"`
+}
+
+// checkPayload checks sign over the hex-encoded JSON payload and that it was
+// signed for action, decodes the payload into v and returns the address of
+// pubKey and the nonce, which the caller has to spend with spendNonce.
+func checkPayload(action, pubKey, payloadHex, sign string, v interface{}) (string, string, error) {
+	verify, err := Verify(pubKey, payloadHex, sign)
+	if err != nil {
+		return "", "", errors.New("verify fail: " + err.Error())
+	}
+
+	if !verify {
+		return "", "", errors.New("verify fail")
+	}
+
+	payloadJson, err := hex.DecodeString(payloadHex)
+	if err != nil {
+		return "", "", err
+	}
+
+	signed := SignedPayload{}
+	err = json.Unmarshal(payloadJson, &signed)
+	if err != nil {
+		return "", "", errors.New("json unmarshal fail")
+	}
+
+	if signed.Action != action {
+		return "", "", errors.New("payload is signed for " + signed.Action + " not " + action)
+	}
+
+	if signed.Nonce == "" {
+		return "", "", errors.New("nonce is null")
+	}
+
+	err = json.Unmarshal(payloadJson, v)
+	if err != nil {
+		return "", "", errors.New("json unmarshal fail")
+	}
+
+	return GetAddress(pubKey), signed.Nonce, nil
+}
+
+// spendNonce records nonce as used by address, in collection for private
+// tokens so the signer is not disclosed, and fails if it was used before.
+func spendNonce(stub shim.ChaincodeStubInterface, collection, address, nonce string) error {
+	compositeKey, err := stub.CreateCompositeKey(NoncePrefix, []string{address, nonce})
+	if err != nil {
+		return err
+	}
+
+	var nonceBytes []byte
+	if collection != "" {
+		nonceBytes, err = stub.GetPrivateData(collection, compositeKey)
+	} else {
+		nonceBytes, err = stub.GetState(compositeKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(nonceBytes) != 0 {
+		return errors.New("nonce " + nonce + " already used by " + address)
+	}
+
+	if collection != "" {
+		return stub.PutPrivateData(collection, compositeKey, []byte(stub.GetTxID()))
+	}
+
+	return stub.PutState(compositeKey, []byte(stub.GetTxID()))
+}
+
+// verifyPayload checks a payload signed for action with checkPayload, spends
+// its nonce and returns the address of pubKey.
+func verifyPayload(stub shim.ChaincodeStubInterface, action, pubKey, payloadHex, sign string, v interface{}) (string, error) {
+	address, nonce, err := checkPayload(action, pubKey, payloadHex, sign, v)
+	if err != nil {
+		return "", err
+	}
+
+	err = spendNonce(stub, "", address, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	return address, nil
+}
+
 type Transfer struct {
 	FromAddress string `json:"fromAddress"`
 	ToAddress   string `json:"toAddress"`
 	TokenID     string `json:"tokenID"`
 	Number      string `json:"number"`
 	TxID        string `json:"txID"`
+	Memo        string `json:"memo,omitempty"`
 }
 
+// args: txID, pubKey, payload hex of Transfer, sign[, coSigner pubKey, coSigner sign]
 func (t *OceanChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 4 {
+	if len(args) != 4 && len(args) != 6 {
 		return shim.Error("incorrect number of args")
 	}
 
@@ -402,26 +996,22 @@ func (t *OceanChaincode) transfer(stub shim.ChaincodeStubInterface, args []strin
 		return shim.Error("txID is null")
 	}
 
-	verify, err := Verify(args[1], args[2], args[3])
-	if !verify {
-		return shim.Error("verify fail: " + err.Error())
-	}
-
-	transferJson, err := hex.DecodeString(args[2])
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
 	tx := Transfer{}
-	err = json.Unmarshal(transferJson, &tx)
+	address, err := verifyPayload(stub, "transfer", args[1], args[2], args[3], &tx)
 	if err != nil {
-		return shim.Error("json unmarshal fail")
+		return shim.Error(err.Error())
 	}
 
-	if GetAddress(args[1]) != tx.FromAddress {
+	if address != tx.FromAddress {
 		return shim.Error("address and public key not match")
 	}
 
+	return t.executeTransfer(stub, txID, &tx, args[2], args[4:])
+}
+
+// executeTransfer moves tx.Number of tx.TokenID once the sender authorized
+// it, checking the spending limit against payloadHex and coSign.
+func (t *OceanChaincode) executeTransfer(stub shim.ChaincodeStubInterface, txID string, tx *Transfer, payloadHex string, coSign []string) pb.Response {
 	if !IsValidAddress(tx.ToAddress) {
 		return shim.Error("toAddress is invalid")
 	}
@@ -430,6 +1020,16 @@ func (t *OceanChaincode) transfer(stub shim.ChaincodeStubInterface, args []strin
 		return shim.Error("fromAddress and toAddress can not be same")
 	}
 
+	err := t.checkNotRetired(stub, tx.FromAddress)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.checkNotRetired(stub, tx.ToAddress)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	if tx.Number == "" || tx.TokenID == "" {
 		return shim.Error("number or tokenID is null string")
 	}
@@ -438,9 +1038,17 @@ func (t *OceanChaincode) transfer(stub shim.ChaincodeStubInterface, args []strin
 		return shim.Error("number need to be greater than 0 integer")
 	}
 
-	tokenIDBytes, err := stub.GetState(TokenPrefix + tx.TokenID)
-	if len(tokenIDBytes) == 0 {
-		return shim.Error("token not exist")
+	token, err := t.getToken(stub, tx.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if token.Collection != "" {
+		return shim.Error("token is private, use transferPrivate")
+	}
+
+	if token.Confidential {
+		return shim.Error("token is confidential, use transferConfidential")
 	}
 
 	transferBytes, err := stub.GetState(TransferPrefix + txID)
@@ -471,8 +1079,13 @@ func (t *OceanChaincode) transfer(stub shim.ChaincodeStubInterface, args []strin
 		return shim.Error("balance of fromAddress " + fromAddrBalance.String() + " less than " + "number " + tx.Number)
 	}
 
+	err = t.checkSpendingLimit(stub, tx.FromAddress, tx.TokenID, tx.Number, payloadHex, coSign)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	tx.TxID = txID
-	txJson, err := json.Marshal(&tx)
+	txJson, err := json.Marshal(tx)
 	if err != nil {
 		return shim.Error("Json marshal fail: " + err.Error())
 	}
@@ -482,22 +1095,30 @@ func (t *OceanChaincode) transfer(stub shim.ChaincodeStubInterface, args []strin
 		return shim.Error(err.Error())
 	}
 
-	compositeKey, err := stub.CreateCompositeKey(WalletPrefix+tx.FromAddress, []string{tx.TokenID, "-", tx.Number, txID})
+	err = t.putTransferDoc(stub, tx)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	err = stub.PutState(compositeKey, []byte{0})
+	err = t.putWalletEntry(stub, "", tx.FromAddress, tx.TokenID, "-", tx.Number, txID)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	compositeKey, err = stub.CreateCompositeKey(WalletPrefix+tx.ToAddress, []string{tx.TokenID, "+", tx.Number, txID})
+	err = t.putWalletEntry(stub, "", tx.ToAddress, tx.TokenID, "+", tx.Number, txID)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	err = stub.PutState(compositeKey, []byte{0})
+	err = t.emitEvent(stub, &Event{
+		Action:  "Transfer",
+		Ref:     txID,
+		TokenID: tx.TokenID,
+		From:    tx.FromAddress,
+		To:      tx.ToAddress,
+		Number:  tx.Number,
+		Memo:    tx.Memo,
+	})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// An order sells SellAmount of SellToken for BuyToken at Price, the amount of
+// BuyToken asked per unit of SellToken, as an exact decimal or fraction. The
+// sell amount is escrowed when the order is placed and matched at once against
+// the opposite side of the book: best price first, then oldest first, always
+// at the resting order's price. Age is the Sequence an order takes from a
+// counter of its token pair, not the transaction timestamp, which the client
+// chooses. Resting orders whose owner may not receive the incoming token are
+// passed over. What is left rests in the book under OrderBookPrefix until
+// filled or cancelled, and a cancel refunds the owner even if it has since
+// been taken off an allowlist.
+
+const (
+	OrderOpen      = "open"
+	OrderFilled    = "filled"
+	OrderCancelled = "cancelled"
+)
+
+type Order struct {
+	OrderID    string `json:"orderID"`
+	Owner      string `json:"owner"`
+	SellToken  string `json:"sellToken"`
+	BuyToken   string `json:"buyToken"`
+	SellAmount string `json:"sellAmount"`
+	Price      string `json:"price"`
+	Remaining  string `json:"remaining"`
+	Received   string `json:"received"`
+	Sequence   int64  `json:"sequence"`
+	Timestamp  int64  `json:"timestamp"`
+	Status     string `json:"status"`
+}
+
+type PriceLevel struct {
+	Price  string `json:"price"`
+	Amount string `json:"amount"`
+	Orders int    `json:"orders"`
+}
+
+type OrderBookDepth struct {
+	SellToken string        `json:"sellToken"`
+	BuyToken  string        `json:"buyToken"`
+	Asks      []*PriceLevel `json:"asks"`
+	Bids      []*PriceLevel `json:"bids"`
+}
+
+func parsePrice(price string) (*big.Rat, error) {
+	rat, success := new(big.Rat).SetString(price)
+	if !success || rat.Sign() <= 0 {
+		return nil, errors.New("price need to be greater than 0: " + price)
+	}
+
+	return rat, nil
+}
+
+// ceilRat rounds r up to an integer.
+func ceilRat(r *big.Rat) *big.Int {
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if m.Sign() > 0 {
+		q.Add(q, big.NewInt(1))
+	}
+
+	return q
+}
+
+// floorRat rounds r, which is not negative, down to an integer.
+func floorRat(r *big.Rat) *big.Int {
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
+
+// nextOrderSequence returns the next sequence number of the token pair of
+// sellToken and buyToken, shared by both sides of its book.
+func nextOrderSequence(stub shim.ChaincodeStubInterface, sellToken, buyToken string) (int64, error) {
+	pair := []string{sellToken, buyToken}
+	sort.Strings(pair)
+
+	compositeKey, err := stub.CreateCompositeKey(OrderSeqPrefix, pair)
+	if err != nil {
+		return 0, err
+	}
+
+	sequenceBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return 0, err
+	}
+
+	var sequence int64
+	if len(sequenceBytes) != 0 {
+		sequence, err = strconv.ParseInt(string(sequenceBytes), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sequence++
+	return sequence, stub.PutState(compositeKey, []byte(strconv.FormatInt(sequence, 10)))
+}
+
+func (t *OceanChaincode) getOrder(stub shim.ChaincodeStubInterface, orderID string) (*Order, error) {
+	orderBytes, err := stub.GetState(OrderPrefix + orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(orderBytes) == 0 {
+		return nil, errors.New("order not exist")
+	}
+
+	order := &Order{}
+	err = json.Unmarshal(orderBytes, order)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return order, nil
+}
+
+// putOrder stores the order and keeps its book entry in step with its status.
+func (t *OceanChaincode) putOrder(stub shim.ChaincodeStubInterface, order *Order) ([]byte, error) {
+	orderJson, err := json.Marshal(order)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(OrderPrefix+order.OrderID, orderJson)
+	if err != nil {
+		return nil, err
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(OrderBookPrefix, []string{order.SellToken, order.BuyToken, order.OrderID})
+	if err != nil {
+		return nil, err
+	}
+
+	if order.Status == OrderOpen {
+		return orderJson, stub.PutState(compositeKey, orderJson)
+	}
+
+	return orderJson, stub.DelState(compositeKey)
+}
+
+// getBookSide returns the open orders selling sellToken for buyToken sorted
+// by price-time priority.
+func (t *OceanChaincode) getBookSide(stub shim.ChaincodeStubInterface, sellToken, buyToken string) ([]*Order, []*big.Rat, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(OrderBookPrefix, []string{sellToken, buyToken})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iterator.Close()
+
+	var orders []*Order
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		order := &Order{}
+		err = json.Unmarshal(responseRange.Value, order)
+		if err != nil {
+			return nil, nil, errors.New("json unmarshal fail")
+		}
+
+		orders = append(orders, order)
+	}
+
+	prices := make(map[string]*big.Rat)
+	for _, order := range orders {
+		price, err := parsePrice(order.Price)
+		if err != nil {
+			return nil, nil, err
+		}
+		prices[order.OrderID] = price
+	}
+
+	sort.SliceStable(orders, func(i, j int) bool {
+		c := prices[orders[i].OrderID].Cmp(prices[orders[j].OrderID])
+		if c != 0 {
+			return c < 0
+		}
+
+		if orders[i].Sequence != orders[j].Sequence {
+			return orders[i].Sequence < orders[j].Sequence
+		}
+
+		return orders[i].OrderID < orders[j].OrderID
+	})
+
+	sorted := make([]*big.Rat, len(orders))
+	for i, order := range orders {
+		sorted[i] = prices[order.OrderID]
+	}
+
+	return orders, sorted, nil
+}
+
+// args: pubKey, payload hex of Order{orderID, sellToken, buyToken, sellAmount, price}, sign[, coSigner pubKey, coSigner sign]
+func (t *OceanChaincode) placeOrder(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 5 {
+		return shim.Error("incorrect number of args")
+	}
+
+	order := Order{}
+	address, err := verifyPayload(stub, "placeOrder", args[0], args[1], args[2], &order)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if order.OrderID == "" {
+		return shim.Error("orderID is null")
+	}
+
+	if order.SellToken == order.BuyToken {
+		return shim.Error("sellToken and buyToken can not be same")
+	}
+
+	if !IsGtZeroInteger(order.SellAmount) {
+		return shim.Error("sellAmount need to be greater than 0 integer")
+	}
+
+	price, err := parsePrice(order.Price)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	sellToken, err := t.getToken(stub, order.SellToken)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	buyToken, err := t.getToken(stub, order.BuyToken)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if sellToken.Collection != "" || buyToken.Collection != "" {
+		return shim.Error("private token can not be traded")
+	}
+
+	orderBytes, err := stub.GetState(OrderPrefix + order.OrderID)
+	if len(orderBytes) != 0 {
+		return shim.Error("order already existed")
+	}
+
+	err = t.debitWallet(stub, sellToken, address, order.SellToken, order.SellAmount, "order:"+order.OrderID, args[1], args[3:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	order.Owner = address
+	order.Price = price.RatString()
+	order.Remaining = order.SellAmount
+	order.Received = "0"
+	order.Status = OrderOpen
+	order.Sequence, err = nextOrderSequence(stub, order.SellToken, order.BuyToken)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	order.Timestamp, err = getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	counters, counterPrices, err := t.getBookSide(stub, order.BuyToken, order.SellToken)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	event := &Event{
+		Action:  "PlaceOrder",
+		Ref:     order.OrderID,
+		TokenID: order.SellToken,
+		From:    order.Owner,
+		Number:  order.SellAmount,
+	}
+
+	remaining, _ := new(big.Int).SetString(order.Remaining, 10)
+	received := big.NewInt(0)
+
+	for i, counter := range counters {
+		// the counter order asks counterPrice of our sell token per unit of
+		// its own; it crosses when that is no worse than our price
+		counterPrice := counterPrices[i]
+		if new(big.Rat).Mul(price, counterPrice).Cmp(big.NewRat(1, 1)) > 0 {
+			break
+		}
+
+		// a resting order whose owner can no longer receive our sell token
+		// stays in the book for its owner to cancel
+		if t.checkAllowed(stub, sellToken, order.SellToken, counter.Owner, "recipient") != nil {
+			continue
+		}
+
+		counterRemaining, _ := new(big.Int).SetString(counter.Remaining, 10)
+
+		// fillBuy of the counter's token costs fillSell of ours, rounded up
+		// in the counter's favour
+		fillBuy := floorRat(new(big.Rat).Quo(new(big.Rat).SetInt(remaining), counterPrice))
+		if fillBuy.Cmp(counterRemaining) > 0 {
+			fillBuy = counterRemaining
+		}
+
+		if fillBuy.Sign() <= 0 {
+			break
+		}
+
+		fillSell := ceilRat(new(big.Rat).Mul(new(big.Rat).SetInt(fillBuy), counterPrice))
+
+		if new(big.Rat).SetInt(fillBuy).Cmp(new(big.Rat).Mul(new(big.Rat).SetInt(fillSell), price)) < 0 {
+			break
+		}
+
+		ref := "fill:" + order.OrderID + ":" + counter.OrderID
+
+		err = t.putWalletEntry(stub, "", order.Owner, order.BuyToken, "+", fillBuy.String(), ref)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = t.putWalletEntry(stub, "", counter.Owner, order.SellToken, "+", fillSell.String(), ref)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		remaining.Sub(remaining, fillSell)
+		received.Add(received, fillBuy)
+
+		counterReceived, _ := new(big.Int).SetString(counter.Received, 10)
+		counter.Remaining = counterRemaining.Sub(counterRemaining, fillBuy).String()
+		counter.Received = counterReceived.Add(counterReceived, fillSell).String()
+		if counterRemaining.Sign() == 0 {
+			counter.Status = OrderFilled
+		}
+
+		_, err = t.putOrder(stub, counter)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		event.Events = append(event.Events, &Event{
+			Action:  "Fill",
+			Ref:     counter.OrderID,
+			TokenID: order.SellToken,
+			From:    order.Owner,
+			To:      counter.Owner,
+			Number:  fillSell.String(),
+		}, &Event{
+			Action:  "Fill",
+			Ref:     order.OrderID,
+			TokenID: order.BuyToken,
+			From:    counter.Owner,
+			To:      order.Owner,
+			Number:  fillBuy.String(),
+		})
+
+		if remaining.Sign() == 0 {
+			break
+		}
+	}
+
+	order.Remaining = remaining.String()
+	order.Received = received.String()
+	if remaining.Sign() == 0 {
+		order.Status = OrderFilled
+	}
+
+	orderJson, err := t.putOrder(stub, &order)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	event.Data = orderJson
+	err = t.emitEvent(stub, event)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(orderJson)
+}
+
+// args: pubKey, payload hex of Order{orderID}, sign
+func (t *OceanChaincode) cancelOrder(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	request := Order{}
+	address, err := verifyPayload(stub, "cancelOrder", args[0], args[1], args[2], &request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	order, err := t.getOrder(stub, request.OrderID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != order.Owner {
+		return shim.Error("only order owner can cancel order")
+	}
+
+	if order.Status != OrderOpen {
+		return shim.Error("order is " + order.Status)
+	}
+
+	refund := order.Remaining
+	order.Status = OrderCancelled
+	order.Remaining = "0"
+
+	orderJson, err := t.putOrder(stub, order)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putRefundEntry(stub, order.Owner, order.SellToken, refund, "cancel:"+order.OrderID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "CancelOrder",
+		Ref:     order.OrderID,
+		TokenID: order.SellToken,
+		To:      order.Owner,
+		Number:  refund,
+		Data:    orderJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// depth aggregates a sorted book side by price.
+func depth(orders []*Order, prices []*big.Rat) []*PriceLevel {
+	var levels []*PriceLevel
+	var amount *big.Int
+	for i, order := range orders {
+		remaining, _ := new(big.Int).SetString(order.Remaining, 10)
+		if i > 0 && prices[i].Cmp(prices[i-1]) == 0 {
+			level := levels[len(levels)-1]
+			level.Amount = amount.Add(amount, remaining).String()
+			level.Orders++
+			continue
+		}
+
+		amount = remaining
+		levels = append(levels, &PriceLevel{
+			Price:  prices[i].RatString(),
+			Amount: amount.String(),
+			Orders: 1,
+		})
+	}
+
+	return levels
+}
+
+// args: sellToken, buyToken
+// asks sell sellToken for buyToken, bids sell buyToken for sellToken
+func (t *OceanChaincode) queryOrderBook(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	asks, askPrices, err := t.getBookSide(stub, args[0], args[1])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	bids, bidPrices, err := t.getBookSide(stub, args[1], args[0])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	depthData, err := json.Marshal(&OrderBookDepth{
+		SellToken: args[0],
+		BuyToken:  args[1],
+		Asks:      depth(asks, askPrices),
+		Bids:      depth(bids, bidPrices),
+	})
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = depthData
+	return t.response(res)
+}
+
+// args: orderID
+func (t *OceanChaincode) queryOrder(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	orderBytes, err := stub.GetState(OrderPrefix + args[0])
+	if len(orderBytes) == 0 || err != nil {
+		res.Msg = "order not exist"
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = orderBytes
+	return t.response(res)
+}
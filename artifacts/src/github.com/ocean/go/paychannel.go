@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A payment channel escrows a deposit of the payer for one payee. Off-chain
+// the payer signs BalanceProofs with action balanceProof, a growing Nonce and
+// the cumulative Amount owed to the payee. The payee closes with the latest
+// proof at any time; the payer can only start a close, which the payee may
+// answer with a newer proof until the challenge period ends. The period runs
+// on ledger time, so a payer can not date its close or the settlement to cut
+// it short. Closing takes a ChannelClose signed for closeChannel, which no
+// proof or open request is.
+
+const (
+	PaymentChannelOpen    = "open"
+	PaymentChannelClosing = "closing"
+	PaymentChannelClosed  = "closed"
+
+	BalanceProofAction = "balanceProof"
+)
+
+type PaymentChannel struct {
+	ChannelID       string `json:"channelID"`
+	Payer           string `json:"payer"`
+	PayerPubKey     string `json:"payerPubKey"`
+	Payee           string `json:"payee"`
+	TokenID         string `json:"tokenID"`
+	Deposit         string `json:"deposit"`
+	ChallengePeriod int64  `json:"challengePeriod"`
+	Status          string `json:"status"`
+	ProofNonce      int64  `json:"proofNonce"`
+	Amount          string `json:"amount"`
+	ClosingAt       int64  `json:"closingAt,omitempty"`
+}
+
+type ChannelClose struct {
+	ChannelID string `json:"channelID"`
+}
+
+type BalanceProof struct {
+	Action    string `json:"action"`
+	ChannelID string `json:"channelID"`
+	Nonce     int64  `json:"nonce"`
+	Amount    string `json:"amount"`
+}
+
+func (t *OceanChaincode) getPaymentChannel(stub shim.ChaincodeStubInterface, channelID string) (*PaymentChannel, error) {
+	channelBytes, err := stub.GetState(PaymentChannelPrefix + channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(channelBytes) == 0 {
+		return nil, errors.New("payment channel not exist")
+	}
+
+	channel := &PaymentChannel{}
+	err = json.Unmarshal(channelBytes, channel)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return channel, nil
+}
+
+func (t *OceanChaincode) putPaymentChannel(stub shim.ChaincodeStubInterface, channel *PaymentChannel) ([]byte, error) {
+	channelJson, err := json.Marshal(channel)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return channelJson, stub.PutState(PaymentChannelPrefix+channel.ChannelID, channelJson)
+}
+
+// args: pubKey, payload hex of PaymentChannel{channelID, payee, tokenID, deposit, challengePeriod}, sign[, coSigner pubKey, coSigner sign]
+func (t *OceanChaincode) openChannel(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 5 {
+		return shim.Error("incorrect number of args")
+	}
+
+	channel := PaymentChannel{}
+	address, err := verifyPayload(stub, "openChannel", args[0], args[1], args[2], &channel)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if channel.ChannelID == "" {
+		return shim.Error("channelID is null")
+	}
+
+	if !IsValidAddress(channel.Payee) || channel.Payee == address {
+		return shim.Error("payee is invalid")
+	}
+
+	if !IsGtZeroInteger(channel.Deposit) {
+		return shim.Error("deposit need to be greater than 0 integer")
+	}
+
+	if channel.ChallengePeriod <= 0 {
+		return shim.Error("challengePeriod need to be greater than 0")
+	}
+
+	token, err := t.getToken(stub, channel.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if token.Collection != "" {
+		return shim.Error("private token can not be used in payment channel")
+	}
+
+	channelBytes, err := stub.GetState(PaymentChannelPrefix + channel.ChannelID)
+	if len(channelBytes) != 0 {
+		return shim.Error("payment channel already existed")
+	}
+
+	err = t.checkNotRetired(stub, channel.Payee)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.debitWallet(stub, token, address, channel.TokenID, channel.Deposit, "channel:"+channel.ChannelID, args[1], args[3:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	channel.Payer = address
+	channel.PayerPubKey = args[0]
+	channel.Status = PaymentChannelOpen
+	channel.ProofNonce = 0
+	channel.Amount = "0"
+	channel.ClosingAt = 0
+
+	channelJson, err := t.putPaymentChannel(stub, &channel)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "OpenChannel",
+		Ref:     channel.ChannelID,
+		TokenID: channel.TokenID,
+		From:    channel.Payer,
+		To:      channel.Payee,
+		Number:  channel.Deposit,
+		Data:    channelJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// applyProof records a payer-signed balance proof newer than the channel's.
+func applyProof(channel *PaymentChannel, proofHex, proofSign string) error {
+	verify, err := Verify(channel.PayerPubKey, proofHex, proofSign)
+	if err != nil || !verify {
+		return errors.New("balance proof verify fail")
+	}
+
+	proofJson, err := hex.DecodeString(proofHex)
+	if err != nil {
+		return err
+	}
+
+	proof := BalanceProof{}
+	err = json.Unmarshal(proofJson, &proof)
+	if err != nil {
+		return errors.New("json unmarshal fail")
+	}
+
+	if proof.Action != BalanceProofAction {
+		return errors.New("balance proof is not signed for " + BalanceProofAction)
+	}
+
+	if proof.ChannelID != channel.ChannelID {
+		return errors.New("balance proof is for channel " + proof.ChannelID)
+	}
+
+	if proof.Nonce <= channel.ProofNonce {
+		return errors.New("balance proof nonce not newer than recorded")
+	}
+
+	amount, success := new(big.Int).SetString(proof.Amount, 10)
+	if !success || amount.Sign() < 0 {
+		return errors.New("amount need to be a non-negative integer")
+	}
+
+	deposit, _ := new(big.Int).SetString(channel.Deposit, 10)
+	if amount.Cmp(deposit) > 0 {
+		return errors.New("amount " + proof.Amount + " greater than deposit " + channel.Deposit)
+	}
+
+	channel.ProofNonce = proof.Nonce
+	channel.Amount = amount.String()
+	return nil
+}
+
+// settlePaymentChannel credits the payee the proven amount and refunds the
+// rest of the deposit to the payer.
+func (t *OceanChaincode) settlePaymentChannel(stub shim.ChaincodeStubInterface, channel *PaymentChannel) pb.Response {
+	deposit, _ := new(big.Int).SetString(channel.Deposit, 10)
+	amount, _ := new(big.Int).SetString(channel.Amount, 10)
+	refund := new(big.Int).Sub(deposit, amount)
+	ref := "channel:" + channel.ChannelID
+
+	if amount.Sign() > 0 {
+		err := t.putWalletEntry(stub, "", channel.Payee, channel.TokenID, "+", amount.String(), ref)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	if refund.Sign() > 0 {
+		err := t.putWalletEntry(stub, "", channel.Payer, channel.TokenID, "+", refund.String(), ref)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	channel.Status = PaymentChannelClosed
+
+	channelJson, err := t.putPaymentChannel(stub, channel)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "SettleChannel",
+		Ref:     channel.ChannelID,
+		TokenID: channel.TokenID,
+		From:    channel.Payer,
+		To:      channel.Payee,
+		Number:  channel.Amount,
+		Data:    channelJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(channelJson)
+}
+
+// args: pubKey of payee or payer, payload hex of ChannelClose{channelID}, sign[, proof hex, payer proof sign]
+// The payee closes and settles at once and must pass a proof. The payer
+// starts the challenge period, optionally recording a proof.
+func (t *OceanChaincode) closeChannel(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 5 {
+		return shim.Error("incorrect number of args")
+	}
+
+	request := ChannelClose{}
+	address, err := verifyPayload(stub, "closeChannel", args[0], args[1], args[2], &request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	channel, err := t.getPaymentChannel(stub, request.ChannelID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if channel.Status == PaymentChannelClosed {
+		return shim.Error("payment channel already closed")
+	}
+
+	if len(args) == 5 {
+		err = applyProof(channel, args[3], args[4])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	if address == channel.Payee {
+		if len(args) != 5 && channel.ProofNonce == 0 {
+			return shim.Error("payee need a balance proof to close")
+		}
+
+		return t.settlePaymentChannel(stub, channel)
+	}
+
+	if address != channel.Payer {
+		return shim.Error("only payer or payee can close payment channel")
+	}
+
+	if channel.Status == PaymentChannelClosing {
+		return shim.Error("payment channel already closing")
+	}
+
+	now, err := getLedgerTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	channel.Status = PaymentChannelClosing
+	channel.ClosingAt = now + channel.ChallengePeriod
+
+	channelJson, err := t.putPaymentChannel(stub, channel)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "CloseChannel",
+		Ref:     channel.ChannelID,
+		TokenID: channel.TokenID,
+		From:    channel.Payer,
+		To:      channel.Payee,
+		Number:  channel.Amount,
+		Data:    channelJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(channelJson)
+}
+
+// args: channelID
+// settles a payer close once the challenge period ended
+func (t *OceanChaincode) settleChannel(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("incorrect number of args")
+	}
+
+	channel, err := t.getPaymentChannel(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if channel.Status != PaymentChannelClosing {
+		return shim.Error("payment channel is " + channel.Status)
+	}
+
+	now, err := getLedgerTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now < channel.ClosingAt {
+		return shim.Error("challenge period not ended")
+	}
+
+	return t.settlePaymentChannel(stub, channel)
+}
+
+// args: channelID
+func (t *OceanChaincode) queryChannel(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	channelBytes, err := stub.GetState(PaymentChannelPrefix + args[0])
+	if len(channelBytes) == 0 || err != nil {
+		res.Msg = "payment channel not exist"
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = channelBytes
+	return t.response(res)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil"
+	"github.com/hyperledger/fabric-amcl/amcl"
+	"github.com/hyperledger/fabric-amcl/amcl/FP256BN"
+	"github.com/hyperledger/fabric/idemix"
+)
+
+// Pedersen commitments v*G + r*H on the FP256BN G1 group. H is hashed onto
+// the curve, so nobody knows its discrete log to G and a commitment cannot be
+// opened to two amounts. A RangeProof shows a commitment holds a value in
+// [0, 2^RangeBits): it commits to each bit and proves, with a Fiat-Shamir OR
+// proof, that each bit commitment opens to 0 or 1; the bits weighted by
+// powers of two must add up to the commitment. Prover functions are for
+// clients, the chaincode only verifies.
+
+const (
+	RangeBits = 64
+
+	pedersenLabel = "ocean.pedersen.H"
+	rangeLabel    = "ocean.range"
+	pointBytes    = 2*int(FP256BN.MODBYTES) + 1
+)
+
+var (
+	pedersenG = idemix.GenG1
+	pedersenH = hashToPoint([]byte(pedersenLabel))
+)
+
+type BitProof struct {
+	Commitment string `json:"commitment"`
+	E0         string `json:"e0"`
+	S0         string `json:"s0"`
+	E1         string `json:"e1"`
+	S1         string `json:"s1"`
+}
+
+type RangeProof struct {
+	Bits []*BitProof `json:"bits"`
+}
+
+// Note is the opening of a commitment, sealed for its recipient.
+type Note struct {
+	Amount   string `json:"amount"`
+	Blinding string `json:"blinding"`
+}
+
+func hashToPoint(data []byte) *FP256BN.ECP {
+	digest := sha256.Sum256(data)
+	return FP256BN.ECP_mapit(digest[:])
+}
+
+func PointToHex(p *FP256BN.ECP) string {
+	b := make([]byte, pointBytes)
+	p.ToBytes(b)
+	return hex.EncodeToString(b)
+}
+
+// PointFromHex decodes a point, failing for anything not on the curve.
+func PointFromHex(s string) (*FP256BN.ECP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != pointBytes || b[0] != 0x04 {
+		return nil, errors.New("point is invalid: " + s)
+	}
+
+	p := FP256BN.ECP_fromBytes(b)
+	if p.Is_infinity() {
+		return nil, errors.New("point is invalid: " + s)
+	}
+
+	return p, nil
+}
+
+func ScalarToHex(s *FP256BN.BIG) string {
+	return hex.EncodeToString(idemix.BigToBytes(s))
+}
+
+// ScalarFromHex decodes a scalar, which must be reduced modulo the group order.
+func ScalarFromHex(s string) (*FP256BN.BIG, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != int(FP256BN.MODBYTES) {
+		return nil, errors.New("scalar is invalid: " + s)
+	}
+
+	order := new(big.Int).SetBytes(idemix.BigToBytes(idemix.GroupOrder))
+	if new(big.Int).SetBytes(b).Cmp(order) >= 0 {
+		return nil, errors.New("scalar is invalid: " + s)
+	}
+
+	return FP256BN.FromBytes(b), nil
+}
+
+func pointEqual(a, b *FP256BN.ECP) bool {
+	return PointToHex(a) == PointToHex(b)
+}
+
+func scalarFromUint64(v uint64) *FP256BN.BIG {
+	b := make([]byte, FP256BN.MODBYTES)
+	binary.BigEndian.PutUint64(b[len(b)-8:], v)
+	return FP256BN.FromBytes(b)
+}
+
+// Commit returns v*G + r*H.
+func Commit(v uint64, r *FP256BN.BIG) *FP256BN.ECP {
+	return pedersenG.Mul2(scalarFromUint64(v), pedersenH, r)
+}
+
+// bitChallenge is the Fiat-Shamir challenge of bit i of a range proof for c.
+func bitChallenge(c *FP256BN.ECP, i int, ci, a0, a1 *FP256BN.ECP) *FP256BN.BIG {
+	data := []byte(rangeLabel)
+	data = append(data, PointToHex(c)...)
+	data = append(data, byte(i))
+	for _, p := range []*FP256BN.ECP{ci, a0, a1} {
+		data = append(data, PointToHex(p)...)
+	}
+
+	return idemix.HashModOrder(data)
+}
+
+// ProveRange proves that Commit(v, r) holds a value in [0, 2^RangeBits).
+func ProveRange(v uint64, r *FP256BN.BIG, rng *amcl.RAND) *RangeProof {
+	c := Commit(v, r)
+	order := idemix.GroupOrder
+
+	// the bit blindings, weighted by powers of two, add up to r
+	blindings := make([]*FP256BN.BIG, RangeBits)
+	sum := FP256BN.NewBIGint(0)
+	for i := 1; i < RangeBits; i++ {
+		blindings[i] = idemix.RandModOrder(rng)
+		weight := scalarFromUint64(1 << uint(i))
+		sum = idemix.Modadd(sum, FP256BN.Modmul(blindings[i], weight, order), order)
+	}
+	blindings[0] = idemix.Modsub(r, sum, order)
+
+	proof := &RangeProof{}
+	for i := 0; i < RangeBits; i++ {
+		bit := int((v >> uint(i)) & 1)
+		ci := Commit(uint64(bit), blindings[i])
+
+		// p[b] = ci - b*G is blindings[i]*H for the real bit only
+		p := []*FP256BN.ECP{NewPoint(ci), NewPoint(ci)}
+		p[1].Sub(pedersenG)
+
+		a := make([]*FP256BN.ECP, 2)
+		e := make([]*FP256BN.BIG, 2)
+		s := make([]*FP256BN.BIG, 2)
+
+		k := idemix.RandModOrder(rng)
+		a[bit] = pedersenH.Mul(k)
+
+		other := 1 - bit
+		e[other] = idemix.RandModOrder(rng)
+		s[other] = idemix.RandModOrder(rng)
+		a[other] = pedersenH.Mul(s[other])
+		a[other].Sub(p[other].Mul(e[other]))
+
+		challenge := bitChallenge(c, i, ci, a[0], a[1])
+		e[bit] = idemix.Modsub(challenge, e[other], order)
+		s[bit] = idemix.Modadd(k, FP256BN.Modmul(e[bit], blindings[i], order), order)
+
+		proof.Bits = append(proof.Bits, &BitProof{
+			Commitment: PointToHex(ci),
+			E0:         ScalarToHex(e[0]),
+			S0:         ScalarToHex(s[0]),
+			E1:         ScalarToHex(e[1]),
+			S1:         ScalarToHex(s[1]),
+		})
+	}
+
+	return proof
+}
+
+// NewPoint returns a copy of p.
+func NewPoint(p *FP256BN.ECP) *FP256BN.ECP {
+	q := FP256BN.NewECP()
+	q.Copy(p)
+	return q
+}
+
+// VerifyRange checks that proof shows c holds a value in [0, 2^RangeBits).
+func VerifyRange(c *FP256BN.ECP, proof *RangeProof) error {
+	if proof == nil || len(proof.Bits) != RangeBits {
+		return errors.New("range proof need " + strconv.Itoa(RangeBits) + " bits")
+	}
+
+	order := idemix.GroupOrder
+	sum := FP256BN.NewECP()
+	for i, bitProof := range proof.Bits {
+		ci, err := PointFromHex(bitProof.Commitment)
+		if err != nil {
+			return err
+		}
+
+		var scalars [4]*FP256BN.BIG
+		for j, s := range []string{bitProof.E0, bitProof.S0, bitProof.E1, bitProof.S1} {
+			scalars[j], err = ScalarFromHex(s)
+			if err != nil {
+				return err
+			}
+		}
+		e0, s0, e1, s1 := scalars[0], scalars[1], scalars[2], scalars[3]
+
+		// a_b = s_b*H - e_b*(ci - b*G)
+		p1 := NewPoint(ci)
+		p1.Sub(pedersenG)
+
+		a0 := pedersenH.Mul(s0)
+		a0.Sub(ci.Mul(e0))
+		a1 := pedersenH.Mul(s1)
+		a1.Sub(p1.Mul(e1))
+
+		challenge := bitChallenge(c, i, ci, a0, a1)
+		if ScalarToHex(idemix.Modadd(e0, e1, order)) != ScalarToHex(challenge) {
+			return errors.New("range proof bit " + strconv.Itoa(i) + " invalid")
+		}
+
+		sum.Add(ci.Mul(scalarFromUint64(1 << uint(i))))
+	}
+
+	if !pointEqual(sum, c) {
+		return errors.New("range proof bits do not add up to commitment")
+	}
+
+	return nil
+}
+
+// SealNote encrypts the opening of a commitment to the secp256k1 public key
+// of its recipient.
+func SealNote(pubKeyHexStr string, note *Note) (string, error) {
+	pubKeyBytes, err := hex.DecodeString(pubKeyHexStr)
+	if err != nil {
+		return "", err
+	}
+
+	pubKey, err := btcec.ParsePubKey(pubKeyBytes, btcec.S256())
+	if err != nil {
+		return "", err
+	}
+
+	noteJson, err := json.Marshal(note)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := btcec.Encrypt(pubKey, noteJson)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sealed), nil
+}
+
+// OpenNote decrypts a note sealed for the key of privKeyWif.
+func OpenNote(privKeyWif, noteHex string) (*Note, error) {
+	wif, err := btcutil.DecodeWIF(privKeyWif)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := hex.DecodeString(noteHex)
+	if err != nil {
+		return nil, err
+	}
+
+	noteJson, err := btcec.Decrypt(wif.PrivKey, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	note := &Note{}
+	err = json.Unmarshal(noteJson, note)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return note, nil
+}
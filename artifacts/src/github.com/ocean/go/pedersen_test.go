@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/hyperledger/fabric-amcl/amcl/FP256BN"
+	"github.com/hyperledger/fabric/idemix"
+)
+
+func proveRange(t *testing.T, v uint64) (*FP256BN.ECP, *FP256BN.BIG, *RangeProof) {
+	rng, err := idemix.GetRand()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := idemix.RandModOrder(rng)
+	return Commit(v, r), r, ProveRange(v, r, rng)
+}
+
+func TestVerifyRange(t *testing.T) {
+	for _, v := range []uint64{0, 1, 1000, math.MaxUint64} {
+		c, _, proof := proveRange(t, v)
+		if err := VerifyRange(c, proof); err != nil {
+			t.Errorf("range proof of %d: %v", v, err)
+		}
+	}
+}
+
+func TestVerifyRangeOutOfRange(t *testing.T) {
+	c, r, proof := proveRange(t, math.MaxUint64)
+
+	// 2^64 and -1 wrap around the range, no proof of an in-range value may pass
+	above := NewPoint(c)
+	above.Add(pedersenG)
+	if err := VerifyRange(above, proof); err == nil {
+		t.Error("range proof of 2^64-1 verified for 2^64")
+	}
+
+	below := Commit(0, r)
+	below.Sub(pedersenG)
+	if err := VerifyRange(below, proof); err == nil {
+		t.Error("range proof of 2^64-1 verified for -1")
+	}
+
+	_, _, zeroProof := proveRange(t, 0)
+	if err := VerifyRange(below, zeroProof); err == nil {
+		t.Error("range proof of 0 verified for -1")
+	}
+}
+
+func TestVerifyRangeTampered(t *testing.T) {
+	c, _, proof := proveRange(t, 1000)
+
+	other, _, _ := proveRange(t, 1000)
+	if err := VerifyRange(other, proof); err == nil {
+		t.Error("range proof verified for another commitment")
+	}
+
+	proof.Bits[3].Commitment = PointToHex(other)
+	if err := VerifyRange(c, proof); err == nil {
+		t.Error("range proof verified with a tampered bit commitment")
+	}
+
+	c, _, proof = proveRange(t, 1000)
+	proof.Bits = proof.Bits[1:]
+	if err := VerifyRange(c, proof); err == nil {
+		t.Error("range proof verified with a missing bit")
+	}
+}
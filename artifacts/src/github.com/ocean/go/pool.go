@@ -0,0 +1,572 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A pool holds reserves of two tokens and prices swaps so the product of the
+// reserves never decreases. Liquidity providers get shares of the derived
+// token "lp/"+poolID, which transfers like any other token but has no issuer:
+// its supply only changes with the pool's shares in setLPSupply. Every
+// division rounds in the pool's favour: providers and traders get the floor,
+// and pay the ceiling.
+
+const (
+	// FeeBase is the denominator of Pool.Fee, so a fee of 30 is 0.3%.
+	FeeBase = 10000
+
+	LPTokenPrefix = "lp/"
+)
+
+type Pool struct {
+	PoolID   string `json:"poolID"`
+	TokenA   string `json:"tokenA"`
+	TokenB   string `json:"tokenB"`
+	Fee      int64  `json:"fee"`
+	ReserveA string `json:"reserveA"`
+	ReserveB string `json:"reserveB"`
+	Shares   string `json:"shares"`
+	LPToken  string `json:"lpToken"`
+}
+
+type Liquidity struct {
+	PoolID    string `json:"poolID"`
+	AmountA   string `json:"amountA"`
+	AmountB   string `json:"amountB"`
+	Shares    string `json:"shares"`
+	MinA      string `json:"minA"`
+	MinB      string `json:"minB"`
+	MinShares string `json:"minShares"`
+}
+
+type Swap struct {
+	PoolID       string `json:"poolID"`
+	TokenIn      string `json:"tokenIn"`
+	AmountIn     string `json:"amountIn"`
+	MinAmountOut string `json:"minAmountOut"`
+}
+
+// isLPToken reports whether tokenID is the LP token of a pool.
+func isLPToken(tokenID string) bool {
+	return strings.HasPrefix(tokenID, LPTokenPrefix)
+}
+
+// parseMinimum reads a lower bound the signer must state, "0" accepting any
+// amount, so a signed payload never trades at whatever price it meets.
+func parseMinimum(name, number string) (*big.Int, error) {
+	if number == "" {
+		return nil, errors.New(name + " is null, 0 accepts any amount")
+	}
+
+	minimum, success := new(big.Int).SetString(number, 10)
+	if !success || minimum.Sign() < 0 {
+		return nil, errors.New(name + " need to be a non-negative integer")
+	}
+
+	return minimum, nil
+}
+
+// mulDivCeil returns ceil(a*b/c).
+func mulDivCeil(a, b, c *big.Int) *big.Int {
+	q, m := new(big.Int).QuoRem(new(big.Int).Mul(a, b), c, new(big.Int))
+	if m.Sign() > 0 {
+		q.Add(q, big.NewInt(1))
+	}
+
+	return q
+}
+
+// mulDivFloor returns floor(a*b/c) for non-negative operands.
+func mulDivFloor(a, b, c *big.Int) *big.Int {
+	return new(big.Int).Quo(new(big.Int).Mul(a, b), c)
+}
+
+func (t *OceanChaincode) getPool(stub shim.ChaincodeStubInterface, poolID string) (*Pool, error) {
+	poolBytes, err := stub.GetState(PoolPrefix + poolID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(poolBytes) == 0 {
+		return nil, errors.New("pool not exist")
+	}
+
+	pool := &Pool{}
+	err = json.Unmarshal(poolBytes, pool)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return pool, nil
+}
+
+func (t *OceanChaincode) putPool(stub shim.ChaincodeStubInterface, pool *Pool) ([]byte, error) {
+	poolJson, err := json.Marshal(pool)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return poolJson, stub.PutState(PoolPrefix+pool.PoolID, poolJson)
+}
+
+// setLPSupply keeps the total number of the LP token equal to the pool's shares.
+func (t *OceanChaincode) setLPSupply(stub shim.ChaincodeStubInterface, pool *Pool) error {
+	token, err := t.getToken(stub, pool.LPToken)
+	if err != nil {
+		return err
+	}
+
+	token.TotalNumber = pool.Shares
+
+	tokenJson, err := json.Marshal(token)
+	if err != nil {
+		return errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return t.putToken(stub, pool.LPToken, tokenJson)
+}
+
+// args: pubKey, payload hex of Pool{poolID, tokenA, tokenB, fee}, sign
+func (t *OceanChaincode) createPool(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	pool := Pool{}
+	address, err := verifyPayload(stub, "createPool", args[0], args[1], args[2], &pool)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if pool.PoolID == "" {
+		return shim.Error("poolID is null")
+	}
+
+	if pool.Fee < 0 || pool.Fee >= FeeBase {
+		return shim.Error("fee need to be between 0 and 9999")
+	}
+
+	// one pool per pair, whichever order the tokens are given in
+	if pool.TokenA > pool.TokenB {
+		pool.TokenA, pool.TokenB = pool.TokenB, pool.TokenA
+	}
+
+	if pool.TokenA == pool.TokenB {
+		return shim.Error("tokenA and tokenB can not be same")
+	}
+
+	for _, tokenID := range []string{pool.TokenA, pool.TokenB} {
+		token, err := t.getToken(stub, tokenID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if token.Collection != "" {
+			return shim.Error("private token can not be pooled")
+		}
+
+		if token.Confidential {
+			return shim.Error("confidential token can not be pooled")
+		}
+	}
+
+	poolBytes, err := stub.GetState(PoolPrefix + pool.PoolID)
+	if len(poolBytes) != 0 {
+		return shim.Error("pool already existed")
+	}
+
+	pairKey, err := stub.CreateCompositeKey(PoolPairPrefix, []string{pool.TokenA, pool.TokenB})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pairBytes, err := stub.GetState(pairKey)
+	if len(pairBytes) != 0 {
+		return shim.Error("pool of pair already existed: " + string(pairBytes))
+	}
+
+	pool.LPToken = LPTokenPrefix + pool.PoolID
+	tokenBytes, err := stub.GetState(TokenPrefix + pool.LPToken)
+	if len(tokenBytes) != 0 {
+		return shim.Error("token already existed")
+	}
+
+	tokenJson, err := json.Marshal(&Token{
+		TokenName:   "LP",
+		TotalNumber: "0",
+	})
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = t.putToken(stub, pool.LPToken, tokenJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = stub.PutState(pairKey, []byte(pool.PoolID))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pool.ReserveA = "0"
+	pool.ReserveB = "0"
+	pool.Shares = "0"
+
+	poolJson, err := t.putPool(stub, &pool)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "CreatePool",
+		Ref:     pool.PoolID,
+		TokenID: pool.LPToken,
+		From:    address,
+		Data:    poolJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: pubKey, payload hex of Liquidity{poolID, amountA, amountB, minShares}, sign[, coSigner pubKey, coSigner sign]
+// at most amountA and amountB are taken, in the ratio of the reserves
+func (t *OceanChaincode) addLiquidity(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 5 {
+		return shim.Error("incorrect number of args")
+	}
+
+	liquidity := Liquidity{}
+	address, err := verifyPayload(stub, "addLiquidity", args[0], args[1], args[2], &liquidity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pool, err := t.getPool(stub, liquidity.PoolID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !IsGtZeroInteger(liquidity.AmountA) || !IsGtZeroInteger(liquidity.AmountB) {
+		return shim.Error("amountA and amountB need to be greater than 0 integer")
+	}
+
+	minShares, err := parseMinimum("minShares", liquidity.MinShares)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	amountA, _ := new(big.Int).SetString(liquidity.AmountA, 10)
+	amountB, _ := new(big.Int).SetString(liquidity.AmountB, 10)
+	reserveA, _ := new(big.Int).SetString(pool.ReserveA, 10)
+	reserveB, _ := new(big.Int).SetString(pool.ReserveB, 10)
+	supply, _ := new(big.Int).SetString(pool.Shares, 10)
+
+	var shares *big.Int
+	if supply.Sign() == 0 {
+		shares = new(big.Int).Sqrt(new(big.Int).Mul(amountA, amountB))
+	} else {
+		shares = mulDivFloor(amountA, supply, reserveA)
+		sharesB := mulDivFloor(amountB, supply, reserveB)
+		if sharesB.Cmp(shares) < 0 {
+			shares = sharesB
+		}
+
+		amountA = mulDivCeil(shares, reserveA, supply)
+		amountB = mulDivCeil(shares, reserveB, supply)
+	}
+
+	if shares.Sign() <= 0 {
+		return shim.Error("liquidity too small")
+	}
+
+	if shares.Cmp(minShares) < 0 {
+		return shim.Error("shares " + shares.String() + " less than minShares " + minShares.String())
+	}
+
+	ref := "pool:" + pool.PoolID + ":" + stub.GetTxID()
+
+	for _, deposit := range []struct {
+		tokenID string
+		amount  *big.Int
+	}{{pool.TokenA, amountA}, {pool.TokenB, amountB}} {
+		token, err := t.getToken(stub, deposit.tokenID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = t.debitWallet(stub, token, address, deposit.tokenID, deposit.amount.String(), ref, args[1], args[3:])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = t.putWalletEntry(stub, "", address, pool.LPToken, "+", shares.String(), ref)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pool.ReserveA = reserveA.Add(reserveA, amountA).String()
+	pool.ReserveB = reserveB.Add(reserveB, amountB).String()
+	pool.Shares = supply.Add(supply, shares).String()
+
+	err = t.setLPSupply(stub, pool)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	poolJson, err := t.putPool(stub, pool)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "AddLiquidity",
+		Ref:     pool.PoolID,
+		TokenID: pool.LPToken,
+		To:      address,
+		Number:  shares.String(),
+		Data:    poolJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(poolJson)
+}
+
+// args: pubKey, payload hex of Liquidity{poolID, shares, minA, minB}, sign[, coSigner pubKey, coSigner sign]
+func (t *OceanChaincode) removeLiquidity(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 5 {
+		return shim.Error("incorrect number of args")
+	}
+
+	liquidity := Liquidity{}
+	address, err := verifyPayload(stub, "removeLiquidity", args[0], args[1], args[2], &liquidity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pool, err := t.getPool(stub, liquidity.PoolID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !IsGtZeroInteger(liquidity.Shares) {
+		return shim.Error("shares need to be greater than 0 integer")
+	}
+
+	minA, err := parseMinimum("minA", liquidity.MinA)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	minB, err := parseMinimum("minB", liquidity.MinB)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	shares, _ := new(big.Int).SetString(liquidity.Shares, 10)
+	reserveA, _ := new(big.Int).SetString(pool.ReserveA, 10)
+	reserveB, _ := new(big.Int).SetString(pool.ReserveB, 10)
+	supply, _ := new(big.Int).SetString(pool.Shares, 10)
+
+	if shares.Cmp(supply) > 0 {
+		return shim.Error("shares greater than pool shares " + pool.Shares)
+	}
+
+	amountA := mulDivFloor(shares, reserveA, supply)
+	amountB := mulDivFloor(shares, reserveB, supply)
+
+	if amountA.Cmp(minA) < 0 || amountB.Cmp(minB) < 0 {
+		return shim.Error("withdrawal " + amountA.String() + "/" + amountB.String() + " less than minimum")
+	}
+
+	lpToken, err := t.getToken(stub, pool.LPToken)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ref := "pool:" + pool.PoolID + ":" + stub.GetTxID()
+
+	err = t.debitWallet(stub, lpToken, address, pool.LPToken, liquidity.Shares, ref, args[1], args[3:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, withdrawal := range []struct {
+		tokenID string
+		amount  *big.Int
+	}{{pool.TokenA, amountA}, {pool.TokenB, amountB}} {
+		if withdrawal.amount.Sign() == 0 {
+			continue
+		}
+
+		err = t.putWalletEntry(stub, "", address, withdrawal.tokenID, "+", withdrawal.amount.String(), ref)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	pool.ReserveA = reserveA.Sub(reserveA, amountA).String()
+	pool.ReserveB = reserveB.Sub(reserveB, amountB).String()
+	pool.Shares = supply.Sub(supply, shares).String()
+
+	err = t.setLPSupply(stub, pool)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	poolJson, err := t.putPool(stub, pool)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "RemoveLiquidity",
+		Ref:     pool.PoolID,
+		TokenID: pool.LPToken,
+		From:    address,
+		Number:  liquidity.Shares,
+		Data:    poolJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(poolJson)
+}
+
+// args: pubKey, payload hex of Swap{poolID, tokenIn, amountIn, minAmountOut}, sign[, coSigner pubKey, coSigner sign]
+func (t *OceanChaincode) swapExact(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 5 {
+		return shim.Error("incorrect number of args")
+	}
+
+	swap := Swap{}
+	address, err := verifyPayload(stub, "swapExact", args[0], args[1], args[2], &swap)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pool, err := t.getPool(stub, swap.PoolID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !IsGtZeroInteger(swap.AmountIn) {
+		return shim.Error("amountIn need to be greater than 0 integer")
+	}
+
+	minAmountOut, err := parseMinimum("minAmountOut", swap.MinAmountOut)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	reserveA, _ := new(big.Int).SetString(pool.ReserveA, 10)
+	reserveB, _ := new(big.Int).SetString(pool.ReserveB, 10)
+
+	reserveIn, reserveOut, tokenOut := reserveA, reserveB, pool.TokenB
+	if swap.TokenIn == pool.TokenB {
+		reserveIn, reserveOut, tokenOut = reserveB, reserveA, pool.TokenA
+	} else if swap.TokenIn != pool.TokenA {
+		return shim.Error("tokenIn not in pool")
+	}
+
+	if reserveIn.Sign() == 0 || reserveOut.Sign() == 0 {
+		return shim.Error("pool has no liquidity")
+	}
+
+	// out = reserveOut * inWithFee / (reserveIn * FeeBase + inWithFee), floored
+	amountIn, _ := new(big.Int).SetString(swap.AmountIn, 10)
+	inWithFee := new(big.Int).Mul(amountIn, big.NewInt(FeeBase-pool.Fee))
+	denominator := new(big.Int).Mul(reserveIn, big.NewInt(FeeBase))
+	denominator.Add(denominator, inWithFee)
+	amountOut := mulDivFloor(reserveOut, inWithFee, denominator)
+
+	if amountOut.Sign() <= 0 {
+		return shim.Error("amountIn too small")
+	}
+
+	if amountOut.Cmp(minAmountOut) < 0 {
+		return shim.Error("amountOut " + amountOut.String() + " less than minAmountOut " + minAmountOut.String())
+	}
+
+	tokenIn, err := t.getToken(stub, swap.TokenIn)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ref := "swap:" + pool.PoolID + ":" + stub.GetTxID()
+
+	err = t.debitWallet(stub, tokenIn, address, swap.TokenIn, swap.AmountIn, ref, args[1], args[3:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putWalletEntry(stub, "", address, tokenOut, "+", amountOut.String(), ref)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	reserveIn.Add(reserveIn, amountIn)
+	reserveOut.Sub(reserveOut, amountOut)
+	pool.ReserveA = reserveA.String()
+	pool.ReserveB = reserveB.String()
+
+	poolJson, err := t.putPool(stub, pool)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "Swap",
+		Ref:     pool.PoolID,
+		TokenID: swap.TokenIn,
+		From:    address,
+		Number:  swap.AmountIn,
+		Data:    poolJson,
+		Events: []*Event{{
+			Action:  "SwapOut",
+			Ref:     pool.PoolID,
+			TokenID: tokenOut,
+			To:      address,
+			Number:  amountOut.String(),
+		}},
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(amountOut.String()))
+}
+
+// args: poolID
+func (t *OceanChaincode) queryPool(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	poolBytes, err := stub.GetState(PoolPrefix + args[0])
+	if len(poolBytes) == 0 || err != nil {
+		res.Msg = "pool not exist"
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = poolBytes
+	return t.response(res)
+}
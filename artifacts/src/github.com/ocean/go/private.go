@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// TransientArgsKey is the transient map entry that carries the JSON array of
+// arguments of private functions, so they never land in the block.
+// TransientSaltKey carries the random salt of the evidence hashes.
+const (
+	TransientArgsKey = "args"
+	TransientSaltKey = "salt"
+
+	minSaltSize = 16
+)
+
+// PrivateEvidence is kept in public state for a transfer of a private token.
+// It holds only hashes of what was verified, salted so the guessable fields
+// can not be recovered from them; the transfer and the salt live in the
+// token's collection.
+type PrivateEvidence struct {
+	TxID        string `json:"txID"`
+	TokenID     string `json:"tokenID"`
+	Collection  string `json:"collection"`
+	PubKeyHash  string `json:"pubKeyHash"`
+	PayloadHash string `json:"payloadHash"`
+	SignHash    string `json:"signHash"`
+}
+
+// PrivateTransfer is the transfer of a private token kept in its collection.
+type PrivateTransfer struct {
+	Transfer
+	Salt string `json:"salt"`
+}
+
+// saltedHash returns the hex sha256 of salt followed by s.
+func saltedHash(salt []byte, s string) string {
+	hash := sha256.Sum256(append(append([]byte{}, salt...), s...))
+	return hex.EncodeToString(hash[:])
+}
+
+func getTransientSalt(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+
+	salt := transient[TransientSaltKey]
+	if len(salt) < minSaltSize {
+		return nil, errors.New("transient " + TransientSaltKey + " need at least " + strconv.Itoa(minSaltSize) + " random bytes")
+	}
+
+	return salt, nil
+}
+
+func getTransientArgs(stub shim.ChaincodeStubInterface) ([]string, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+
+	argsJson, ok := transient[TransientArgsKey]
+	if !ok {
+		return nil, errors.New("transient " + TransientArgsKey + " not found")
+	}
+
+	var args []string
+	err = json.Unmarshal(argsJson, &args)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return args, nil
+}
+
+// transient args: txID, pubKey, payload hex of Transfer, sign[, coSigner pubKey, coSigner sign]
+// transient salt: random bytes for the evidence hashes
+func (t *OceanChaincode) transferPrivate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("args must be passed in transient")
+	}
+
+	args, err := getTransientArgs(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(args) != 4 && len(args) != 6 {
+		return shim.Error("incorrect number of args")
+	}
+
+	salt, err := getTransientSalt(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	txID := args[0]
+	if txID == "" {
+		return shim.Error("txID is null")
+	}
+
+	tx := Transfer{}
+	address, nonce, err := checkPayload("transferPrivate", args[1], args[2], args[3], &tx)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != tx.FromAddress {
+		return shim.Error("address and public key not match")
+	}
+
+	if !IsValidAddress(tx.ToAddress) {
+		return shim.Error("toAddress is invalid")
+	}
+
+	if tx.FromAddress == tx.ToAddress {
+		return shim.Error("fromAddress and toAddress can not be same")
+	}
+
+	err = t.checkNotRetired(stub, tx.FromAddress)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.checkNotRetired(stub, tx.ToAddress)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !IsGtZeroInteger(tx.Number) {
+		return shim.Error("number need to be greater than 0 integer")
+	}
+
+	token, err := t.getToken(stub, tx.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if token.Collection == "" {
+		return shim.Error("token is not private, use transfer")
+	}
+
+	err = spendNonce(stub, token.Collection, address, nonce)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	transferBytes, err := stub.GetState(TransferPrefix + txID)
+	if len(transferBytes) != 0 {
+		return shim.Error("transfer already existed")
+	}
+
+	balance, err := t.getTokenBalance(stub, tx.FromAddress, tx.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	number, _ := new(big.Int).SetString(tx.Number, 10)
+	if balance.Cmp(number) < 0 {
+		return shim.Error("balance of fromAddress " + balance.String() + " less than " + "number " + tx.Number)
+	}
+
+	err = t.checkSpendingLimit(stub, tx.FromAddress, tx.TokenID, tx.Number, args[2], args[4:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tx.TxID = txID
+	txJson, err := json.Marshal(&PrivateTransfer{Transfer: tx, Salt: hex.EncodeToString(salt)})
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutPrivateData(token.Collection, TransferPrefix+txID, txJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	evidence := PrivateEvidence{
+		TxID:        txID,
+		TokenID:     tx.TokenID,
+		Collection:  token.Collection,
+		PubKeyHash:  saltedHash(salt, args[1]),
+		PayloadHash: saltedHash(salt, args[2]),
+		SignHash:    saltedHash(salt, args[3]),
+	}
+
+	evidenceJson, err := json.Marshal(&evidence)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(TransferPrefix+txID, evidenceJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putWalletEntry(stub, token.Collection, tx.FromAddress, tx.TokenID, "-", tx.Number, txID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putWalletEntry(stub, token.Collection, tx.ToAddress, tx.TokenID, "+", tx.Number, txID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// parties, amount and memo stay in the collection
+	err = t.emitEvent(stub, &Event{
+		Action:  "TransferPrivate",
+		Ref:     txID,
+		TokenID: tx.TokenID,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: address, tokenID
+func (t *OceanChaincode) queryPrivateBalance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	balance, err := t.getTokenBalance(stub, args[0], args[1])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	balanceData, err := json.Marshal(&TokenBalance{TokenID: args[1], Balance: balance.String()})
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = balanceData
+	return t.response(res)
+}
+
+// args: txID
+func (t *OceanChaincode) queryPrivateTx(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	txID := args[0]
+
+	evidenceBytes, err := stub.GetState(TransferPrefix + txID)
+	if len(evidenceBytes) == 0 || err != nil {
+		res.Msg = "transfer not exist"
+		return t.response(res)
+	}
+
+	evidence := PrivateEvidence{}
+	err = json.Unmarshal(evidenceBytes, &evidence)
+	if err != nil || evidence.Collection == "" {
+		res.Msg = "transfer is not private"
+		return t.response(res)
+	}
+
+	txBytes, err := stub.GetPrivateData(evidence.Collection, TransferPrefix+txID)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	if len(txBytes) == 0 {
+		res.Msg = "transfer not visible to this peer"
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = txBytes
+	return t.response(res)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// An issuance quota caps the supply an organization, by the MSP ID of the
+// requester, or an issuer address may issue and mint per period. Periods of
+// Period seconds count from Start and are told by ledger time, so a requester
+// can not date an issuance into a fresh period; a zero Period is a single
+// period without end. Usage is kept per subject and period under
+// QuotaUsagePrefix and is charged when an issuance executes. Each quota lives
+// at one key, so its changes can be audited through queryQuotaHistory.
+
+const MSPSubjectPrefix = "msp:"
+
+type IssuanceQuota struct {
+	MSPID   string `json:"mspID,omitempty"`
+	Address string `json:"address,omitempty"`
+	Limit   string `json:"limit"`
+	Period  int64  `json:"period"`
+	Start   int64  `json:"start"`
+	Remove  bool   `json:"remove,omitempty"`
+}
+
+type QuotaUsage struct {
+	Subject   string         `json:"subject"`
+	Quota     *IssuanceQuota `json:"quota"`
+	Index     int64          `json:"index"`
+	Used      string         `json:"used"`
+	Remaining string         `json:"remaining"`
+}
+
+type QuotaChange struct {
+	TxID      string          `json:"txID"`
+	Timestamp int64           `json:"timestamp"`
+	IsDelete  bool            `json:"isDelete"`
+	Quota     json.RawMessage `json:"quota,omitempty"`
+}
+
+func (quota *IssuanceQuota) subject() string {
+	if quota.MSPID != "" {
+		return MSPSubjectPrefix + quota.MSPID
+	}
+
+	return quota.Address
+}
+
+// periodIndex returns the period of quota that now, in seconds, falls in.
+func (quota *IssuanceQuota) periodIndex(now int64) int64 {
+	if quota.Period == 0 || now < quota.Start {
+		return 0
+	}
+
+	return (now - quota.Start) / quota.Period
+}
+
+func (t *OceanChaincode) getQuota(stub shim.ChaincodeStubInterface, subject string) (*IssuanceQuota, error) {
+	quotaBytes, err := stub.GetState(QuotaPrefix + subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(quotaBytes) == 0 {
+		return nil, nil
+	}
+
+	quota := &IssuanceQuota{}
+	err = json.Unmarshal(quotaBytes, quota)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return quota, nil
+}
+
+// getQuotaUsage returns the usage of subject in the current period, nil if
+// subject has no quota.
+func (t *OceanChaincode) getQuotaUsage(stub shim.ChaincodeStubInterface, subject string) (*QuotaUsage, string, error) {
+	quota, err := t.getQuota(stub, subject)
+	if err != nil || quota == nil {
+		return nil, "", err
+	}
+
+	now, err := getLedgerTime(stub)
+	if err != nil {
+		return nil, "", err
+	}
+
+	index := quota.periodIndex(now)
+	usageKey, err := stub.CreateCompositeKey(QuotaUsagePrefix, []string{subject, strconv.FormatInt(index, 10)})
+	if err != nil {
+		return nil, "", err
+	}
+
+	usageBytes, err := stub.GetState(usageKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	used := "0"
+	if len(usageBytes) != 0 {
+		used = string(usageBytes)
+	}
+
+	usedNumber, _ := new(big.Int).SetString(used, 10)
+	limit, _ := new(big.Int).SetString(quota.Limit, 10)
+	remaining := new(big.Int).Sub(limit, usedNumber)
+	if remaining.Sign() < 0 {
+		remaining.SetInt64(0)
+	}
+
+	return &QuotaUsage{
+		Subject:   subject,
+		Quota:     quota,
+		Index:     index,
+		Used:      used,
+		Remaining: remaining.String(),
+	}, usageKey, nil
+}
+
+// chargeQuota adds number to the usage of subject, failing past its limit.
+func (t *OceanChaincode) chargeQuota(stub shim.ChaincodeStubInterface, subject, number string) error {
+	usage, usageKey, err := t.getQuotaUsage(stub, subject)
+	if err != nil || usage == nil {
+		return err
+	}
+
+	amount, _ := new(big.Int).SetString(number, 10)
+	remaining, _ := new(big.Int).SetString(usage.Remaining, 10)
+	if amount.Cmp(remaining) > 0 {
+		return errors.New("issuance quota of " + subject + " exceeded, remaining " + usage.Remaining)
+	}
+
+	used, _ := new(big.Int).SetString(usage.Used, 10)
+	return stub.PutState(usageKey, []byte(used.Add(used, amount).String()))
+}
+
+// chargeIssuanceQuotas charges an issuance of number by issuer to the quotas
+// of the issuer address and of the requesting organization.
+func (t *OceanChaincode) chargeIssuanceQuotas(stub shim.ChaincodeStubInterface, request *IssuanceRequest, issuer, number string) error {
+	err := t.chargeQuota(stub, issuer, number)
+	if err != nil {
+		return err
+	}
+
+	if request.Requester == "" {
+		return nil
+	}
+
+	return t.chargeQuota(stub, MSPSubjectPrefix+request.Requester, number)
+}
+
+// args: IssuanceQuota json{mspID or address, limit, period, start, remove}
+// start defaults to the current period start, or now for a new quota
+func (t *OceanChaincode) setQuota(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("incorrect number of args")
+	}
+
+	quota := IssuanceQuota{}
+	err := json.Unmarshal([]byte(args[0]), &quota)
+	if err != nil {
+		return shim.Error("json unmarshal fail")
+	}
+
+	if (quota.MSPID == "") == (quota.Address == "") {
+		return shim.Error("quota need either mspID or address")
+	}
+
+	if quota.Address != "" && !IsValidAddress(quota.Address) {
+		return shim.Error("address is invalid")
+	}
+
+	subject := quota.subject()
+
+	if quota.Remove {
+		err = stub.DelState(QuotaPrefix + subject)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = t.emitEvent(stub, &Event{Action: "RemoveQuota", Ref: subject})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		return shim.Success(nil)
+	}
+
+	if !IsGtZeroInteger(quota.Limit) {
+		return shim.Error("limit need to be greater than 0 integer")
+	}
+
+	if quota.Period < 0 || quota.Start < 0 {
+		return shim.Error("period and start can not be negative")
+	}
+
+	if quota.Start == 0 {
+		current, err := t.getQuota(stub, subject)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// keep counting the periods already used
+		if current != nil {
+			quota.Start = current.Start
+		} else {
+			now, err := getTxTimestamp(stub)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			quota.Start = now / int64(time.Second)
+		}
+	}
+
+	quotaJson, err := json.Marshal(&quota)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(QuotaPrefix+subject, quotaJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{Action: "SetQuota", Ref: subject, Number: quota.Limit, Data: quotaJson})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: subject, msp:<mspID> or issuer address
+func (t *OceanChaincode) queryQuota(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	usage, _, err := t.getQuotaUsage(stub, args[0])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	if usage == nil {
+		res.Msg = "quota not exist"
+		return t.response(res)
+	}
+
+	usageData, err := json.Marshal(usage)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = usageData
+	return t.response(res)
+}
+
+// args: subject, msp:<mspID> or issuer address
+// returns every change of the quota, oldest first
+func (t *OceanChaincode) queryQuotaHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	iterator, err := stub.GetHistoryForKey(QuotaPrefix + args[0])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+	defer iterator.Close()
+
+	var changes []*QuotaChange
+	for iterator.HasNext() {
+		modification, err := iterator.Next()
+		if err != nil {
+			res.Msg = err.Error()
+			return t.response(res)
+		}
+
+		change := &QuotaChange{
+			TxID:     modification.TxId,
+			IsDelete: modification.IsDelete,
+		}
+		if modification.Timestamp != nil {
+			change.Timestamp = modification.Timestamp.Seconds
+		}
+		if !modification.IsDelete {
+			change.Quota = modification.Value
+		}
+
+		changes = append(changes, change)
+	}
+
+	changesData, err := json.Marshal(changes)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = changesData
+	return t.response(res)
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// An address registers a RecoveryPolicy while it still holds its key. If the
+// key is lost or compromised, a guardian or the issuer of a listed token
+// requests recovery to a new address. Once enough guardians approved and
+// Delay seconds of ledger time passed without the old key cancelling,
+// executeRecovery moves the balances and, for a guardian recovery, marks the
+// old address retired. Balances of private tokens are only read from their
+// collections when the executor names the tokens; what a guardian recovery
+// leaves behind is moved by another one to the same new address.
+// Every new policy must carry a higher Version than the one it replaces.
+
+const (
+	MinRecoveryDelay = 24 * 60 * 60
+
+	RecoveryPending   = "pending"
+	RecoveryCancelled = "cancelled"
+	RecoveryExecuted  = "executed"
+)
+
+type RecoveryPolicy struct {
+	Address      string   `json:"address"`
+	Guardians    []string `json:"guardians"`
+	Threshold    int      `json:"threshold"`
+	IssuerTokens []string `json:"issuerTokens"`
+	Delay        int64    `json:"delay"`
+	Version      int64    `json:"version"`
+}
+
+// Recovery is a request to move the balances of Address to NewAddress. With
+// TokenID set it was requested by that token's issuer and moves only that
+// token, otherwise it needs Threshold guardian approvals and moves the public
+// and confidential balances and those of the private tokens named on execution.
+type Recovery struct {
+	Address     string   `json:"address"`
+	NewAddress  string   `json:"newAddress"`
+	TokenID     string   `json:"tokenID"`
+	Approvals   []string `json:"approvals"`
+	RequestedAt int64    `json:"requestedAt"`
+	Status      string   `json:"status"`
+}
+
+// Retired is stored for an address whose balances were recovered.
+type Retired struct {
+	Address    string `json:"address"`
+	NewAddress string `json:"newAddress"`
+}
+
+func (t *OceanChaincode) getRecoveryPolicy(stub shim.ChaincodeStubInterface, address string) (*RecoveryPolicy, error) {
+	policyBytes, err := stub.GetState(RecoveryPolicyPrefix + address)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(policyBytes) == 0 {
+		return nil, errors.New("recovery policy not exist")
+	}
+
+	policy := &RecoveryPolicy{}
+	err = json.Unmarshal(policyBytes, policy)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return policy, nil
+}
+
+func (t *OceanChaincode) getRecovery(stub shim.ChaincodeStubInterface, address string) (*Recovery, error) {
+	recoveryBytes, err := stub.GetState(RecoveryPrefix + address)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recoveryBytes) == 0 {
+		return nil, nil
+	}
+
+	recovery := &Recovery{}
+	err = json.Unmarshal(recoveryBytes, recovery)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return recovery, nil
+}
+
+func (t *OceanChaincode) putRecovery(stub shim.ChaincodeStubInterface, recovery *Recovery) ([]byte, error) {
+	recoveryJson, err := json.Marshal(recovery)
+	if err != nil {
+		return nil, errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return recoveryJson, stub.PutState(RecoveryPrefix+recovery.Address, recoveryJson)
+}
+
+func (t *OceanChaincode) getRetired(stub shim.ChaincodeStubInterface, address string) (*Retired, error) {
+	retiredBytes, err := stub.GetState(RetiredPrefix + address)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(retiredBytes) == 0 {
+		return nil, nil
+	}
+
+	retired := &Retired{}
+	err = json.Unmarshal(retiredBytes, retired)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return retired, nil
+}
+
+// checkNotRetired fails if address was retired by a recovery.
+func (t *OceanChaincode) checkNotRetired(stub shim.ChaincodeStubInterface, address string) error {
+	retired, err := t.getRetired(stub, address)
+	if err != nil {
+		return err
+	}
+
+	if retired != nil {
+		return errors.New("address " + address + " is retired, balances moved to " + retired.NewAddress)
+	}
+
+	return nil
+}
+
+// args: pubKey, payload hex of RecoveryPolicy{guardians, threshold, issuerTokens, delay, version}, sign
+func (t *OceanChaincode) setRecoveryPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	policy := RecoveryPolicy{}
+	address, err := verifyPayload(stub, "setRecoveryPolicy", args[0], args[1], args[2], &policy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.checkNotRetired(stub, address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(policy.Guardians) == 0 && len(policy.IssuerTokens) == 0 {
+		return shim.Error("policy need guardians or issuerTokens")
+	}
+
+	seen := make(map[string]bool)
+	for _, guardian := range policy.Guardians {
+		if !IsValidAddress(guardian) || guardian == address || seen[guardian] {
+			return shim.Error("guardians must be unique valid addresses other than owner")
+		}
+		seen[guardian] = true
+	}
+
+	if len(policy.Guardians) != 0 && (policy.Threshold < 1 || policy.Threshold > len(policy.Guardians)) {
+		return shim.Error("threshold need to be between 1 and number of guardians")
+	}
+
+	for _, tokenID := range policy.IssuerTokens {
+		if isLPToken(tokenID) {
+			return shim.Error("LP token has no issuer")
+		}
+
+		_, err = t.getToken(stub, tokenID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	if policy.Delay < MinRecoveryDelay {
+		return shim.Error("delay need to be at least " + time.Duration(MinRecoveryDelay*time.Second).String())
+	}
+
+	current, err := t.getRecoveryPolicy(stub, address)
+	if err == nil && policy.Version <= current.Version {
+		return shim.Error("version need to be greater than " + strconv.FormatInt(current.Version, 10))
+	}
+
+	policy.Address = address
+
+	policyJson, err := json.Marshal(&policy)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(RecoveryPolicyPrefix+address, policyJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action: "SetRecoveryPolicy",
+		From:   address,
+		Data:   policyJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: pubKey of a guardian or token issuer, payload hex of Recovery{address, newAddress, tokenID}, sign
+func (t *OceanChaincode) requestRecovery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	request := Recovery{}
+	signer, err := verifyPayload(stub, "requestRecovery", args[0], args[1], args[2], &request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !IsValidAddress(request.NewAddress) || request.NewAddress == request.Address {
+		return shim.Error("newAddress is invalid")
+	}
+
+	policy, err := t.getRecoveryPolicy(stub, request.Address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// a retired address can still have other tokens recovered, to the same successor
+	retired, err := t.getRetired(stub, request.Address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if retired != nil && retired.NewAddress != request.NewAddress {
+		return shim.Error("address already recovered to " + retired.NewAddress)
+	}
+
+	recovery, err := t.getRecovery(stub, request.Address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if recovery != nil && recovery.Status == RecoveryPending {
+		return shim.Error("recovery already pending")
+	}
+
+	if request.TokenID == "" {
+		if !inSlice(signer, policy.Guardians) {
+			return shim.Error("signer is not a guardian")
+		}
+	} else {
+		if !inSlice(request.TokenID, policy.IssuerTokens) || isLPToken(request.TokenID) {
+			return shim.Error("token " + request.TokenID + " is not in recovery policy")
+		}
+
+		token, err := t.getToken(stub, request.TokenID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if signer != token.Address {
+			return shim.Error("signer is not the token issuer")
+		}
+	}
+
+	now, err := getLedgerTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	request.Approvals = []string{signer}
+	request.RequestedAt = now
+	request.Status = RecoveryPending
+
+	recoveryJson, err := t.putRecovery(stub, &request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "RequestRecovery",
+		TokenID: request.TokenID,
+		From:    request.Address,
+		To:      request.NewAddress,
+		Data:    recoveryJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: pubKey of a guardian, payload hex of Recovery{address, newAddress}, sign
+func (t *OceanChaincode) approveRecovery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	approval := Recovery{}
+	signer, err := verifyPayload(stub, "approveRecovery", args[0], args[1], args[2], &approval)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	policy, err := t.getRecoveryPolicy(stub, approval.Address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recovery, err := t.getRecovery(stub, approval.Address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if recovery == nil || recovery.Status != RecoveryPending {
+		return shim.Error("no pending recovery")
+	}
+
+	if recovery.TokenID != "" {
+		return shim.Error("issuer recovery needs no approval")
+	}
+
+	if recovery.NewAddress != approval.NewAddress {
+		return shim.Error("newAddress does not match pending recovery")
+	}
+
+	if !inSlice(signer, policy.Guardians) {
+		return shim.Error("signer is not a guardian")
+	}
+
+	if inSlice(signer, recovery.Approvals) {
+		return shim.Error("guardian already approved")
+	}
+
+	recovery.Approvals = append(recovery.Approvals, signer)
+
+	recoveryJson, err := t.putRecovery(stub, recovery)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action: "ApproveRecovery",
+		From:   recovery.Address,
+		To:     recovery.NewAddress,
+		Data:   recoveryJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: pubKey of the address being recovered, payload hex of Recovery{address}, sign
+func (t *OceanChaincode) cancelRecovery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	cancel := Recovery{}
+	signer, err := verifyPayload(stub, "cancelRecovery", args[0], args[1], args[2], &cancel)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if signer != cancel.Address {
+		return shim.Error("only the address owner can cancel recovery")
+	}
+
+	recovery, err := t.getRecovery(stub, cancel.Address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if recovery == nil || recovery.Status != RecoveryPending {
+		return shim.Error("no pending recovery")
+	}
+
+	recovery.Status = RecoveryCancelled
+
+	recoveryJson, err := t.putRecovery(stub, recovery)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action: "CancelRecovery",
+		From:   recovery.Address,
+		To:     recovery.NewAddress,
+		Data:   recoveryJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: address[, tokenID of a private token...]
+func (t *OceanChaincode) executeRecovery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error("incorrect number of args")
+	}
+
+	address := args[0]
+
+	policy, err := t.getRecoveryPolicy(stub, address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recovery, err := t.getRecovery(stub, address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if recovery == nil || recovery.Status != RecoveryPending {
+		return shim.Error("no pending recovery")
+	}
+
+	if recovery.TokenID == "" && len(recovery.Approvals) < policy.Threshold {
+		return shim.Error("not enough guardian approvals")
+	}
+
+	now, err := getLedgerTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now < recovery.RequestedAt+policy.Delay {
+		return shim.Error("recovery waiting period not ended")
+	}
+
+	if recovery.TokenID != "" && len(args) != 1 {
+		return shim.Error("issuer recovery moves only token " + recovery.TokenID)
+	}
+
+	var balances []*TokenBalance
+	var confidential []string
+	if recovery.TokenID == "" {
+		balanceInfo, err := t.getBalance(stub, address)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		balances = balanceInfo.TokenBalances
+
+		// getBalance reads no collection, private tokens are named by the executor
+		for i, tokenID := range args[1:] {
+			if inSlice(tokenID, args[1:i+1]) {
+				return shim.Error("token " + tokenID + " named twice")
+			}
+
+			token, err := t.getToken(stub, tokenID)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+
+			if token.Collection == "" {
+				return shim.Error("token " + tokenID + " is not private")
+			}
+
+			balance, err := t.getTokenBalance(stub, address, tokenID)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			balances = append(balances, &TokenBalance{TokenID: tokenID, BalanceNumeric: balance})
+		}
+
+		confidential, err = t.getConfidentialTokenIDs(stub, address)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		balance, err := t.getTokenBalance(stub, address, recovery.TokenID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		balances = append(balances, &TokenBalance{TokenID: recovery.TokenID, BalanceNumeric: balance})
+		confidential = append(confidential, recovery.TokenID)
+	}
+
+	ref := "recover:" + stub.GetTxID()
+	event := &Event{
+		Action: "ExecuteRecovery",
+		From:   address,
+		To:     recovery.NewAddress,
+	}
+
+	for _, balance := range balances {
+		if balance.BalanceNumeric.Sign() <= 0 {
+			continue
+		}
+
+		token, err := t.getToken(stub, balance.TokenID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		number := balance.BalanceNumeric.String()
+
+		err = t.putWalletEntry(stub, token.Collection, address, balance.TokenID, "-", number, ref)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = t.putWalletEntry(stub, token.Collection, recovery.NewAddress, balance.TokenID, "+", number, ref)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if token.Collection == "" {
+			event.Events = append(event.Events, &Event{
+				Action:  "Transfer",
+				Ref:     ref,
+				TokenID: balance.TokenID,
+				From:    address,
+				To:      recovery.NewAddress,
+				Number:  number,
+			})
+		}
+	}
+
+	// the amount stays hidden, the whole commitment to the balance moves
+	for _, tokenID := range confidential {
+		token, err := t.getToken(stub, tokenID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if !token.Confidential {
+			continue
+		}
+
+		balance, entries, err := t.getConfidentialBalance(stub, address, tokenID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if len(entries) == 0 {
+			continue
+		}
+
+		err = t.putConfidentialEntry(stub, token, address, tokenID, "-", balance, "", ref)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = t.putConfidentialEntry(stub, token, recovery.NewAddress, tokenID, "+", balance, "", ref)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		event.Events = append(event.Events, &Event{
+			Action:  "TransferConfidential",
+			Ref:     ref,
+			TokenID: tokenID,
+			From:    address,
+			To:      recovery.NewAddress,
+		})
+	}
+
+	recovery.Status = RecoveryExecuted
+
+	recoveryJson, err := t.putRecovery(stub, recovery)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// an issuer recovery moves one token, the address keeps the others
+	if recovery.TokenID == "" {
+		retiredJson, err := json.Marshal(&Retired{Address: address, NewAddress: recovery.NewAddress})
+		if err != nil {
+			return shim.Error("Json marshal fail: " + err.Error())
+		}
+
+		err = stub.PutState(RetiredPrefix+address, retiredJson)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	event.Data = recoveryJson
+	err = t.emitEvent(stub, event)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: address
+func (t *OceanChaincode) queryRecovery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	recovery, err := t.getRecovery(stub, args[0])
+	if err != nil || recovery == nil {
+		res.Msg = "recovery not exist"
+		return t.response(res)
+	}
+
+	recoveryData, err := json.Marshal(recovery)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = recoveryData
+	return t.response(res)
+}
+
+// getConfidentialTokenIDs returns the confidential tokens address has entries of.
+func (t *OceanChaincode) getConfidentialTokenIDs(stub shim.ChaincodeStubInterface, address string) ([]string, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(ConfidentialPrefix, []string{address})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var tokenIDs []string
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		if !inSlice(compositeKeyParts[1], tokenIDs) {
+			tokenIDs = append(tokenIDs, compositeKeyParts[1])
+		}
+	}
+
+	return tokenIDs, nil
+}
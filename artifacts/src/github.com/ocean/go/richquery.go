@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// With rich query enabled, every public token, transfer and wallet entry is
+// also written as a JSON document with a docType, so peers on CouchDB can
+// serve GetQueryResult from the indexes under META-INF/statedb/couchdb. The
+// composite key layout stays the source of balances; documents only cover
+// writes made while enabled. Transfer documents are written by transfer and
+// transferX509 only; cheques, mandates, channel settlements, order fills, pool
+// swaps, holds, airdrops and the other flows that move tokens show up as
+// wallet documents, so queryWalletEntries sees every movement while the
+// transfer queries cover direct transfers. Amounts keep their exact decimal string in
+// number and an order-preserving sortKey for range selectors and sorting.
+// Timestamps are unix seconds.
+
+const (
+	DocTypeToken    = "token"
+	DocTypeTransfer = "transfer"
+	DocTypeWallet   = "wallet"
+
+	richQueryLimit    = 100
+	richQueryMaxLimit = 1000
+)
+
+type RichQueryConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+type TokenDoc struct {
+	DocType string `json:"docType"`
+	TokenID string `json:"tokenID"`
+	Token
+}
+
+type TransferDoc struct {
+	DocType   string `json:"docType"`
+	TxID      string `json:"txID"`
+	TokenID   string `json:"tokenID"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Number    string `json:"number"`
+	SortKey   string `json:"sortKey"`
+	Timestamp int64  `json:"timestamp"`
+	Memo      string `json:"memo,omitempty"`
+}
+
+type WalletDoc struct {
+	DocType   string `json:"docType"`
+	Address   string `json:"address"`
+	TokenID   string `json:"tokenID"`
+	Operation string `json:"operation"`
+	Number    string `json:"number"`
+	SortKey   string `json:"sortKey"`
+	Ref       string `json:"ref"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func (t *OceanChaincode) richQueryEnabled(stub shim.ChaincodeStubInterface) (bool, error) {
+	configBytes, err := stub.GetState(RichQueryKey)
+	if err != nil {
+		return false, err
+	}
+
+	config := RichQueryConfig{}
+	if len(configBytes) != 0 {
+		err = json.Unmarshal(configBytes, &config)
+		if err != nil {
+			return false, errors.New("json unmarshal fail")
+		}
+	}
+
+	return config.Enabled, nil
+}
+
+// numberSortKey returns the digit count of the decimal number, zero-padded to
+// three places, and then its digits, so the keys of numbers below 10^999
+// sort like the numbers. It returns "" for anything else.
+func numberSortKey(number string) string {
+	n, success := new(big.Int).SetString(number, 10)
+	if !success || n.Sign() < 0 {
+		return ""
+	}
+
+	digits := n.String()
+	return fmt.Sprintf("%03d", len(digits)) + digits
+}
+
+func (t *OceanChaincode) putDoc(stub shim.ChaincodeStubInterface, objectType string, attributes []string, doc interface{}) error {
+	enabled, err := t.richQueryEnabled(stub)
+	if err != nil || !enabled {
+		return err
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return err
+	}
+
+	docJson, err := json.Marshal(doc)
+	if err != nil {
+		return errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return stub.PutState(compositeKey, docJson)
+}
+
+func (t *OceanChaincode) putTokenDoc(stub shim.ChaincodeStubInterface, tokenID string, tokenJson []byte) error {
+	doc := &TokenDoc{DocType: DocTypeToken, TokenID: tokenID}
+	err := json.Unmarshal(tokenJson, &doc.Token)
+	if err != nil {
+		return errors.New("json unmarshal fail")
+	}
+
+	if doc.Collection != "" {
+		return nil
+	}
+
+	return t.putDoc(stub, TokenDocPrefix, []string{tokenID}, doc)
+}
+
+func (t *OceanChaincode) putTransferDoc(stub shim.ChaincodeStubInterface, tx *Transfer) error {
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	return t.putDoc(stub, TransferDocPrefix, []string{tx.TxID}, &TransferDoc{
+		DocType:   DocTypeTransfer,
+		TxID:      tx.TxID,
+		TokenID:   tx.TokenID,
+		From:      tx.FromAddress,
+		To:        tx.ToAddress,
+		Number:    tx.Number,
+		SortKey:   numberSortKey(tx.Number),
+		Timestamp: timestamp / int64(time.Second),
+		Memo:      tx.Memo,
+	})
+}
+
+func (t *OceanChaincode) putWalletDoc(stub shim.ChaincodeStubInterface, address, tokenID, operation, number, ref string, timestamp int64) error {
+	return t.putDoc(stub, WalletDocPrefix, []string{address, tokenID, operation, number, ref}, &WalletDoc{
+		DocType:   DocTypeWallet,
+		Address:   address,
+		TokenID:   tokenID,
+		Operation: operation,
+		Number:    number,
+		SortKey:   numberSortKey(number),
+		Ref:       ref,
+		Timestamp: timestamp / int64(time.Second),
+	})
+}
+
+// parseLimit reads the optional result limit in args[index].
+func parseLimit(args []string, index int) (int, error) {
+	if len(args) <= index || args[index] == "" {
+		return richQueryLimit, nil
+	}
+
+	limit, err := strconv.Atoi(args[index])
+	if err != nil || limit < 1 || limit > richQueryMaxLimit {
+		return 0, errors.New("limit need to be between 1 and " + strconv.Itoa(richQueryMaxLimit))
+	}
+
+	return limit, nil
+}
+
+// richQuery runs a Mango query and decodes every document with decode.
+func richQuery(stub shim.ChaincodeStubInterface, query map[string]interface{}, decode func(value []byte) error) error {
+	queryJson, err := json.Marshal(query)
+	if err != nil {
+		return errors.New("Json marshal fail: " + err.Error())
+	}
+
+	iterator, err := stub.GetQueryResult(string(queryJson))
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+
+		err = decode(responseRange.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// richQueryResponse returns the documents of query.
+func (t *OceanChaincode) richQueryResponse(stub shim.ChaincodeStubInterface, query map[string]interface{}) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	docs := []json.RawMessage{}
+	err := richQuery(stub, query, func(value []byte) error {
+		docs = append(docs, json.RawMessage(value))
+		return nil
+	})
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	docsData, err := json.Marshal(docs)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = docsData
+	return t.response(res)
+}
+
+// args: RichQueryConfig json{enabled}
+func (t *OceanChaincode) configureRichQuery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("incorrect number of args")
+	}
+
+	config := RichQueryConfig{}
+	err := json.Unmarshal([]byte(args[0]), &config)
+	if err != nil {
+		return shim.Error("json unmarshal fail")
+	}
+
+	configJson, err := json.Marshal(&config)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(RichQueryKey, configJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{Action: "ConfigureRichQuery", Data: configJson})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: tokenID, from, to[, limit]
+// returns the direct transfers of tokenID from unix second from up to before to, oldest first
+func (t *OceanChaincode) queryTransfersByToken(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 3 && len(args) != 4 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	from, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		res.Msg = "from is invalid"
+		return t.response(res)
+	}
+
+	to, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || to <= from {
+		res.Msg = "to need to be after from"
+		return t.response(res)
+	}
+
+	limit, err := parseLimit(args, 3)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	query := map[string]interface{}{
+		"selector": map[string]interface{}{
+			"docType":   DocTypeTransfer,
+			"tokenID":   args[0],
+			"timestamp": map[string]interface{}{"$gte": from, "$lt": to},
+		},
+		"sort": []map[string]string{
+			{"docType": "asc"},
+			{"tokenID": "asc"},
+			{"timestamp": "asc"},
+		},
+		"use_index": []string{"_design/indexTransferTokenTimeDoc", "indexTransferTokenTime"},
+		"limit":     limit,
+	}
+
+	return t.richQueryResponse(stub, query)
+}
+
+// args: threshold[, tokenID, limit]
+// returns the direct transfers of at least threshold, largest first
+func (t *OceanChaincode) queryLargeTransfers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) < 1 || len(args) > 3 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	if !IsGtZeroInteger(args[0]) {
+		res.Msg = "threshold need to be greater than 0 integer"
+		return t.response(res)
+	}
+	limit, err := parseLimit(args, 2)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	selector := map[string]interface{}{
+		"docType": DocTypeTransfer,
+		"sortKey": map[string]interface{}{"$gte": numberSortKey(args[0])},
+	}
+	sort := []map[string]string{{"docType": "desc"}, {"sortKey": "desc"}}
+	index := []string{"_design/indexTransferValueDoc", "indexTransferValue"}
+
+	if len(args) > 1 && args[1] != "" {
+		selector["tokenID"] = args[1]
+		sort = []map[string]string{{"docType": "desc"}, {"tokenID": "desc"}, {"sortKey": "desc"}}
+		index = []string{"_design/indexTransferTokenValueDoc", "indexTransferTokenValue"}
+	}
+
+	query := map[string]interface{}{
+		"selector":  selector,
+		"sort":      sort,
+		"use_index": index,
+		"limit":     limit,
+	}
+
+	return t.richQueryResponse(stub, query)
+}
+
+// args: address, tokenID, from, to[, limit]
+// returns the wallet entries of address for tokenID from unix second from up to before to, oldest first
+func (t *OceanChaincode) queryWalletEntries(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 4 && len(args) != 5 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	from, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		res.Msg = "from is invalid"
+		return t.response(res)
+	}
+
+	to, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || to <= from {
+		res.Msg = "to need to be after from"
+		return t.response(res)
+	}
+
+	limit, err := parseLimit(args, 4)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	query := map[string]interface{}{
+		"selector": map[string]interface{}{
+			"docType":   DocTypeWallet,
+			"address":   args[0],
+			"tokenID":   args[1],
+			"timestamp": map[string]interface{}{"$gte": from, "$lt": to},
+		},
+		"sort": []map[string]string{
+			{"docType": "asc"},
+			{"address": "asc"},
+			{"tokenID": "asc"},
+			{"timestamp": "asc"},
+		},
+		"use_index": []string{"_design/indexWalletDoc", "indexWallet"},
+		"limit":     limit,
+	}
+
+	return t.richQueryResponse(stub, query)
+}
+
+// args: issuer address[, limit]
+func (t *OceanChaincode) queryTokensByIssuer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 && len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	limit, err := parseLimit(args, 1)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	query := map[string]interface{}{
+		"selector": map[string]interface{}{
+			"docType": DocTypeToken,
+			"address": args[0],
+		},
+		"use_index": []string{"_design/indexTokenDoc", "indexToken"},
+		"limit":     limit,
+	}
+
+	return t.richQueryResponse(stub, query)
+}
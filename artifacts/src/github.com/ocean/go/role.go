@@ -0,0 +1,522 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Roles are granted to submitters of proposals, not to secp256k1 addresses. A
+// RoleBinding matches creators of one MSP, optionally narrowed to a
+// certificate common name and a Fabric CA attribute value, and may name the
+// Signer address its identities sign role duties off-chain with. functionRoles
+// declares what each function in Invoke requires; a function without roles is
+// open to every channel member, and one missing from it can not be invoked.
+// Init binds admin to the instantiating identity while no admin exists, and
+// admins manage the registry from then on.
+
+const (
+	RoleAdmin      = "admin"
+	RoleIssuer     = "issuer"
+	RoleCompliance = "compliance"
+	RoleAuditor    = "auditor"
+	RoleTimekeeper = "timekeeper"
+)
+
+// attrOID is the certificate extension Fabric CA stores attributes in.
+var attrOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+var roles = []string{RoleAdmin, RoleIssuer, RoleCompliance, RoleAuditor, RoleTimekeeper}
+
+var functionRoles = map[string][]string{
+	"delete":                   {RoleAdmin},
+	"query":                    nil,
+	"initValue":                {RoleAdmin},
+	"move":                     {RoleAdmin},
+	"queryToken":               nil,
+	"queryBalance":             nil,
+	"issueToken":               {RoleIssuer},
+	"transfer":                 nil,
+	"queryTx":                  nil,
+	"createSnapshot":           {RoleIssuer},
+	"querySnapshot":            nil,
+	"balanceAt":                nil,
+	"createProposal":           nil,
+	"castVote":                 nil,
+	"tallyProposal":            nil,
+	"queryProposal":            nil,
+	"transferPrivate":          nil,
+	"queryPrivateBalance":      nil,
+	"queryPrivateTx":           nil,
+	"registerCaller":           {RoleIssuer},
+	"authorizeCaller":          nil,
+	"balanceOf":                nil,
+	"hold":                     nil,
+	"settle":                   nil,
+	"release":                  nil,
+	"queryHold":                nil,
+	"configureBridge":          {RoleAdmin},
+	"lockToken":                nil,
+	"mintWrapped":              nil,
+	"burnWrapped":              nil,
+	"unlockToken":              nil,
+	"queryBridgeSupply":        nil,
+	"setRecoveryPolicy":        nil,
+	"requestRecovery":          nil,
+	"approveRecovery":          nil,
+	"cancelRecovery":           nil,
+	"executeRecovery":          nil,
+	"queryRecovery":            nil,
+	"tick":                     {RoleTimekeeper},
+	"queryClock":               nil,
+	"setSpendingLimit":         nil,
+	"querySpendingLimit":       nil,
+	"cashCheque":               nil,
+	"voidCheque":               nil,
+	"queryCheque":              nil,
+	"openChannel":              nil,
+	"closeChannel":             nil,
+	"settleChannel":            nil,
+	"queryChannel":             nil,
+	"createMandate":            nil,
+	"collect":                  nil,
+	"cancelMandate":            nil,
+	"queryMandate":             nil,
+	"placeOrder":               nil,
+	"cancelOrder":              nil,
+	"queryOrderBook":           nil,
+	"queryOrder":               nil,
+	"createPool":               nil,
+	"addLiquidity":             nil,
+	"removeLiquidity":          nil,
+	"swapExact":                nil,
+	"queryPool":                nil,
+	"setPermissioned":          {RoleIssuer},
+	"updateAllowlist":          {RoleIssuer, RoleCompliance},
+	"queryAllowlist":           nil,
+	"registerAttestor":         {RoleAdmin, RoleIssuer, RoleCompliance},
+	"issueClaim":               nil,
+	"revokeClaim":              nil,
+	"setClaimRules":            {RoleIssuer, RoleCompliance},
+	"queryClaims":              nil,
+	"grantRole":                {RoleAdmin},
+	"revokeRole":               {RoleAdmin},
+	"queryRoles":               nil,
+	"queryCreatorRoles":        nil,
+	"transferX509":             nil,
+	"configureIdemix":          {RoleAdmin},
+	"transferAnonymous":        nil,
+	"queryNymAddress":          nil,
+	"transferConfidential":     nil,
+	"queryConfidentialBalance": nil,
+	"mint":                     {RoleIssuer},
+	"approveIssuance":          nil,
+	"expireIssuance":           nil,
+	"setIssuancePolicy":        {RoleAdmin},
+	"queryIssuancePolicy":      nil,
+	"queryIssuanceRequest":     nil,
+	"setQuota":                 {RoleAdmin},
+	"queryQuota":               nil,
+	"queryQuotaHistory":        {RoleAdmin, RoleAuditor},
+	"attestBalances":           {RoleIssuer},
+	"proveBalance":             nil,
+	"queryAttestation":         nil,
+	"fundAirdrop":              nil,
+	"claimAirdrop":             nil,
+	"reclaimAirdrop":           nil,
+	"queryAirdrop":             nil,
+	"auditToken":               {RoleAuditor},
+	"signAudit":                {RoleAuditor},
+	"queryAudit":               nil,
+	"configureRichQuery":       {RoleAdmin},
+	"queryTransfersByToken":    nil,
+	"queryLargeTransfers":      nil,
+	"queryWalletEntries":       nil,
+	"queryTokensByIssuer":      nil,
+}
+
+type RoleBinding struct {
+	BindingID  string `json:"bindingID"`
+	Role       string `json:"role"`
+	MSPID      string `json:"mspID"`
+	CommonName string `json:"commonName,omitempty"`
+	Attribute  string `json:"attribute,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Signer     string `json:"signer,omitempty"`
+	TxID       string `json:"txID"`
+}
+
+// Creator is the submitter of a proposal as role bindings see it.
+type Creator struct {
+	MSPID      string            `json:"mspID"`
+	CommonName string            `json:"commonName"`
+	Address    string            `json:"address"`
+	Attributes map[string]string `json:"attributes"`
+	Roles      []string          `json:"roles"`
+}
+
+// getCreatorCert returns the MSP ID and certificate of the creator.
+func getCreatorCert(stub shim.ChaincodeStubInterface) (string, *x509.Certificate, error) {
+	identity, err := getCreator(stub)
+	if err != nil {
+		return "", nil, err
+	}
+
+	block, _ := pem.Decode(identity.IdBytes)
+	if block == nil {
+		return "", nil, errors.New("creator certificate decode fail")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", nil, errors.New("creator certificate parse fail: " + err.Error())
+	}
+
+	return identity.Mspid, cert, nil
+}
+
+// getCreatorIdentity parses the creator's certificate for its common name
+// and Fabric CA attributes.
+func getCreatorIdentity(stub shim.ChaincodeStubInterface) (*Creator, error) {
+	mspID, cert, err := getCreatorCert(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	creator := &Creator{
+		MSPID:      mspID,
+		CommonName: cert.Subject.CommonName,
+		Address:    GetX509Address(mspID, cert),
+		Attributes: make(map[string]string),
+	}
+
+	for _, extension := range cert.Extensions {
+		if !extension.Id.Equal(attrOID) {
+			continue
+		}
+
+		attrs := struct {
+			Attrs map[string]string `json:"attrs"`
+		}{}
+		err = json.Unmarshal(extension.Value, &attrs)
+		if err != nil {
+			return nil, errors.New("creator attributes unmarshal fail")
+		}
+
+		for name, value := range attrs.Attrs {
+			creator.Attributes[name] = value
+		}
+	}
+
+	return creator, nil
+}
+
+func (binding *RoleBinding) matches(creator *Creator) bool {
+	if binding.MSPID != creator.MSPID {
+		return false
+	}
+
+	if binding.CommonName != "" && binding.CommonName != creator.CommonName {
+		return false
+	}
+
+	if binding.Attribute != "" && creator.Attributes[binding.Attribute] != binding.Value {
+		return false
+	}
+
+	return true
+}
+
+func (t *OceanChaincode) getRoleBindings(stub shim.ChaincodeStubInterface, role string) ([]*RoleBinding, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(RolePrefix, []string{role})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var bindings []*RoleBinding
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		binding := &RoleBinding{}
+		err = json.Unmarshal(responseRange.Value, binding)
+		if err != nil {
+			return nil, errors.New("json unmarshal fail")
+		}
+
+		bindings = append(bindings, binding)
+	}
+
+	return bindings, nil
+}
+
+func (t *OceanChaincode) hasRole(stub shim.ChaincodeStubInterface, creator *Creator, role string) (bool, error) {
+	bindings, err := t.getRoleBindings(stub, role)
+	if err != nil {
+		return false, err
+	}
+
+	for _, binding := range bindings {
+		if binding.matches(creator) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isRoleSigner reports whether signer is the Signer of a binding of role that
+// matches creator.
+func (t *OceanChaincode) isRoleSigner(stub shim.ChaincodeStubInterface, creator *Creator, role, signer string) (bool, error) {
+	bindings, err := t.getRoleBindings(stub, role)
+	if err != nil {
+		return false, err
+	}
+
+	for _, binding := range bindings {
+		if binding.Signer != "" && binding.Signer == signer && binding.matches(creator) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// checkRoles fails unless function is declared in functionRoles and the
+// creator holds one of the roles it requires.
+func (t *OceanChaincode) checkRoles(stub shim.ChaincodeStubInterface, function string) error {
+	required, ok := functionRoles[function]
+	if !ok {
+		return errors.New("function " + function + " is not declared in functionRoles")
+	}
+
+	if len(required) == 0 {
+		return nil
+	}
+
+	creator, err := getCreatorIdentity(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, role := range required {
+		held, err := t.hasRole(stub, creator, role)
+		if err != nil {
+			return err
+		}
+
+		if held {
+			return nil
+		}
+	}
+
+	return errors.New(function + " requires role " + strings.Join(required, " or "))
+}
+
+func (t *OceanChaincode) putRoleBinding(stub shim.ChaincodeStubInterface, binding *RoleBinding) error {
+	compositeKey, err := stub.CreateCompositeKey(RolePrefix, []string{binding.Role, binding.BindingID})
+	if err != nil {
+		return err
+	}
+
+	binding.TxID = stub.GetTxID()
+
+	bindingJson, err := json.Marshal(binding)
+	if err != nil {
+		return errors.New("Json marshal fail: " + err.Error())
+	}
+
+	return stub.PutState(compositeKey, bindingJson)
+}
+
+// bootstrapAdmin binds admin to the creator's MSP and common name while the
+// registry has no admin.
+func (t *OceanChaincode) bootstrapAdmin(stub shim.ChaincodeStubInterface) error {
+	admins, err := t.getRoleBindings(stub, RoleAdmin)
+	if err != nil || len(admins) != 0 {
+		return err
+	}
+
+	creator, err := getCreatorIdentity(stub)
+	if err != nil {
+		return err
+	}
+
+	return t.putRoleBinding(stub, &RoleBinding{
+		BindingID:  "bootstrap",
+		Role:       RoleAdmin,
+		MSPID:      creator.MSPID,
+		CommonName: creator.CommonName,
+	})
+}
+
+// args: RoleBinding json{bindingID, role, mspID, commonName, attribute, value, signer}
+func (t *OceanChaincode) grantRole(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("incorrect number of args")
+	}
+
+	binding := RoleBinding{}
+	err := json.Unmarshal([]byte(args[0]), &binding)
+	if err != nil {
+		return shim.Error("json unmarshal fail")
+	}
+
+	if !inSlice(binding.Role, roles) {
+		return shim.Error("role need to be one of " + strings.Join(roles, ", "))
+	}
+
+	if binding.BindingID == "" {
+		return shim.Error("bindingID is null")
+	}
+
+	if binding.MSPID == "" {
+		return shim.Error("mspID is null")
+	}
+
+	if binding.Attribute == "" && binding.Value != "" {
+		return shim.Error("value need an attribute")
+	}
+
+	if binding.Signer != "" && !IsValidAddress(binding.Signer) {
+		return shim.Error("signer is invalid")
+	}
+
+	err = t.putRoleBinding(stub, &binding)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bindingJson, err := json.Marshal(&binding)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{Action: "GrantRole", Ref: binding.Role, Data: bindingJson})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: role, bindingID
+func (t *OceanChaincode) revokeRole(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("incorrect number of args")
+	}
+
+	bindings, err := t.getRoleBindings(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var revoked *RoleBinding
+	for _, binding := range bindings {
+		if binding.BindingID == args[1] {
+			revoked = binding
+		}
+	}
+
+	if revoked == nil {
+		return shim.Error("role binding not exist")
+	}
+
+	if revoked.Role == RoleAdmin && len(bindings) == 1 {
+		return shim.Error("can not revoke the last admin binding")
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(RolePrefix, []string{args[0], args[1]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = stub.DelState(compositeKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bindingJson, err := json.Marshal(revoked)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{Action: "RevokeRole", Ref: revoked.Role, Data: bindingJson})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// args: role
+func (t *OceanChaincode) queryRoles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 1 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	bindings, err := t.getRoleBindings(stub, args[0])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	bindingsData, err := json.Marshal(bindings)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = bindingsData
+	return t.response(res)
+}
+
+// args: none
+// returns the creator's identity, its x509 account address and the roles it holds
+func (t *OceanChaincode) queryCreatorRoles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	creator, err := getCreatorIdentity(stub)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	creator.Roles = []string{}
+	for _, role := range roles {
+		held, err := t.hasRole(stub, creator, role)
+		if err != nil {
+			res.Msg = err.Error()
+			return t.response(res)
+		}
+
+		if held {
+			creator.Roles = append(creator.Roles, role)
+		}
+	}
+
+	creatorData, err := json.Marshal(creator)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = creatorData
+	return t.response(res)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Snapshot marks a point in the ledger of a token. Every snapshot of a token,
+// and every proposal, attestation and audit that fixes its balances, takes
+// the next number of a per-token sequence, and every wallet entry stores the
+// sequence current when it was written. The balance at a snapshot sums the
+// entries stored before it, so nothing is copied when the snapshot is
+// created, and no transaction timestamp, which the client chooses, can move
+// an entry in front of it.
+type Snapshot struct {
+	SnapshotID string `json:"snapshotID"`
+	TokenID    string `json:"tokenID"`
+	Sequence   int64  `json:"sequence"`
+	Timestamp  int64  `json:"timestamp"`
+	TxID       string `json:"txID"`
+}
+
+// getSnapshotSequence returns the number of snapshots taken of tokenID.
+func getSnapshotSequence(stub shim.ChaincodeStubInterface, tokenID string) (int64, error) {
+	sequenceBytes, err := stub.GetState(SnapshotSeqKey + tokenID)
+	if err != nil || len(sequenceBytes) == 0 {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(sequenceBytes), 10, 64)
+}
+
+// nextSnapshotSequence takes a snapshot of tokenID and returns its sequence.
+// Wallet entries written from now on carry it and are not counted at it.
+func nextSnapshotSequence(stub shim.ChaincodeStubInterface, tokenID string) (int64, error) {
+	sequence, err := getSnapshotSequence(stub, tokenID)
+	if err != nil {
+		return 0, err
+	}
+
+	sequence++
+	return sequence, stub.PutState(SnapshotSeqKey+tokenID, []byte(strconv.FormatInt(sequence, 10)))
+}
+
+// args: pubKey, payload hex of Snapshot{snapshotID, tokenID}, sign
+func (t *OceanChaincode) createSnapshot(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("incorrect number of args")
+	}
+
+	snapshot := Snapshot{}
+	address, err := verifyPayload(stub, "createSnapshot", args[0], args[1], args[2], &snapshot)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if snapshot.SnapshotID == "" || snapshot.TokenID == "" {
+		return shim.Error("snapshotID or tokenID is null string")
+	}
+
+	token, err := t.getToken(stub, snapshot.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if address != token.Address {
+		return shim.Error("only token issuer can create snapshot")
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(SnapshotPrefix, []string{snapshot.TokenID, snapshot.SnapshotID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	snapshotBytes, err := stub.GetState(compositeKey)
+	if len(snapshotBytes) != 0 {
+		return shim.Error("snapshot already existed")
+	}
+
+	snapshot.Sequence, err = nextSnapshotSequence(stub, snapshot.TokenID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	snapshot.Timestamp, err = getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	snapshot.TxID = stub.GetTxID()
+
+	snapshotJson, err := json.Marshal(&snapshot)
+	if err != nil {
+		return shim.Error("Json marshal fail: " + err.Error())
+	}
+
+	err = stub.PutState(compositeKey, snapshotJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emitEvent(stub, &Event{
+		Action:  "CreateSnapshot",
+		Ref:     snapshot.SnapshotID,
+		TokenID: snapshot.TokenID,
+		From:    address,
+		Data:    snapshotJson,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+func (t *OceanChaincode) getSnapshot(stub shim.ChaincodeStubInterface, tokenID, snapshotID string) (*Snapshot, error) {
+	compositeKey, err := stub.CreateCompositeKey(SnapshotPrefix, []string{tokenID, snapshotID})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotBytes, err := stub.GetState(compositeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(snapshotBytes) == 0 {
+		return nil, errors.New("snapshot not exist")
+	}
+
+	snapshot := &Snapshot{}
+	err = json.Unmarshal(snapshotBytes, snapshot)
+	if err != nil {
+		return nil, errors.New("json unmarshal fail")
+	}
+
+	return snapshot, nil
+}
+
+// args: tokenID, snapshotID
+func (t *OceanChaincode) querySnapshot(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 2 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	snapshot, err := t.getSnapshot(stub, args[0], args[1])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	snapshotData, err := json.Marshal(snapshot)
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = snapshotData
+	return t.response(res)
+}
+
+// getBalanceAt sums the wallet entries of tokenID for address written before
+// the snapshot with sequence.
+func (t *OceanChaincode) getBalanceAt(stub shim.ChaincodeStubInterface, address, tokenID string, sequence int64) (*big.Int, error) {
+	iterator, err := t.getWalletIterator(stub, address, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	balance := big.NewInt(0)
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		entry, err := getWalletEntry(responseRange.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Sequence >= sequence {
+			continue
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		operation := compositeKeyParts[1]
+		num := compositeKeyParts[2]
+
+		numBigInt, success := new(big.Int).SetString(num, 10)
+		if !success {
+			return nil, errors.New("number not match: " + num)
+		}
+
+		if operation == "+" {
+			balance.Add(balance, numBigInt)
+		} else {
+			balance.Sub(balance, numBigInt)
+		}
+	}
+
+	return balance, nil
+}
+
+// args: address, tokenID, snapshotID
+func (t *OceanChaincode) balanceAt(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	res := &Response{}
+	res.Status = false
+
+	if len(args) != 3 {
+		res.Msg = "incorrect number of args"
+		return t.response(res)
+	}
+
+	address := args[0]
+	tokenID := args[1]
+
+	snapshot, err := t.getSnapshot(stub, tokenID, args[2])
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	balance, err := t.getBalanceAt(stub, address, tokenID, snapshot.Sequence)
+	if err != nil {
+		res.Msg = err.Error()
+		return t.response(res)
+	}
+
+	balanceData, err := json.Marshal(&TokenBalance{TokenID: tokenID, Balance: balance.String()})
+	if err != nil {
+		res.Msg = "Json marshal fail: " + err.Error()
+		return t.response(res)
+	}
+
+	res.Status = true
+	res.Data = balanceData
+	return t.response(res)
+}
@@ -222,6 +222,10 @@ func inSlice(versionAddr string, valids []string) bool {
 }
 
 func IsValidAddress(addr string) bool {
+	if IsX509Address(addr) || IsNymAddress(addr) {
+		return true
+	}
+
 	valid, versionAddr := TypeOf(addr)
 
 	if !valid {
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// An x509 account belongs to a Fabric enrollment instead of a secp256k1 key.
+// Its address is X509AddressPrefix and the first 20 bytes, in hex, of the
+// sha256 of the MSP ID, certificate subject and issuer, so it survives
+// re-enrollment and can never be mistaken for a base58 address. The creator
+// of the proposal authorizes its transfers, no signature is passed in args.
+
+const (
+	X509AddressPrefix = "x509:"
+	x509AddressLength = 40
+)
+
+// GetX509Address returns the account address of the enrollment cert of mspID.
+func GetX509Address(mspID string, cert *x509.Certificate) string {
+	hash := sha256.New()
+	hash.Write([]byte(mspID))
+	hash.Write([]byte{0})
+	hash.Write(cert.RawSubject)
+	hash.Write([]byte{0})
+	hash.Write(cert.RawIssuer)
+
+	return X509AddressPrefix + hex.EncodeToString(hash.Sum(nil))[:x509AddressLength]
+}
+
+func IsX509Address(addr string) bool {
+	if !strings.HasPrefix(addr, X509AddressPrefix) {
+		return false
+	}
+
+	digest := addr[len(X509AddressPrefix):]
+	if len(digest) != x509AddressLength || strings.ToLower(digest) != digest {
+		return false
+	}
+
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
+
+// getCreatorAddress returns the x509 account address of the creator.
+func getCreatorAddress(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, cert, err := getCreatorCert(stub)
+	if err != nil {
+		return "", err
+	}
+
+	return GetX509Address(mspID, cert), nil
+}
+
+// args: txID, Transfer json{toAddress, tokenID, number, memo}
+// transfers from the creator's x509 account
+func (t *OceanChaincode) transferX509(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("incorrect number of args")
+	}
+
+	txID := args[0]
+	if txID == "" {
+		return shim.Error("txID is null")
+	}
+
+	tx := Transfer{}
+	err := json.Unmarshal([]byte(args[1]), &tx)
+	if err != nil {
+		return shim.Error("json unmarshal fail")
+	}
+
+	address, err := getCreatorAddress(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if tx.FromAddress != "" && tx.FromAddress != address {
+		return shim.Error("fromAddress and creator not match")
+	}
+	tx.FromAddress = address
+
+	return t.executeTransfer(stub, txID, &tx, "", nil)
+}